@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// clientIdentity returns identity of the client, either from IdentityHeader (set by authenticating proxy) or client's IP
+func clientIdentity(req *http.Request) string {
+	if config.IdentityHeader != "" {
+		if id := req.Header.Get(config.IdentityHeader); id != "" {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func isAdmin(req *http.Request) bool {
+	identity := clientIdentity(req)
+	for _, admin := range config.AdminIdentities {
+		if admin == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// denyNonAdmin responds 403 and returns true if the client is not listed in AdminIdentities
+func denyNonAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if isAdmin(req) {
+		return false
+	}
+	logger.Warn("access denied",
+		zap.String("identity", clientIdentity(req)),
+		zap.String("uri", req.RequestURI),
+		zap.Int("http_code", http.StatusForbidden),
+	)
+	http.Error(w, "Access denied", http.StatusForbidden)
+	return true
+}
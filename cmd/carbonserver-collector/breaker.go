@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// breakerGraphType is used to persist circuit breaker state in flamegraph_metadata
+const breakerGraphType = "circuit_breaker"
+
+type breakerConfig struct {
+	// MaxChange is a relative change of amount of metrics compared to the last normal snapshot that makes snapshot anomalous
+	MaxChange float64
+	// OpenAfter consecutive anomalous snapshots stop writes for the cluster, 0 disables the breaker
+	OpenAfter int
+	// CloseAfter consecutive normal snapshots resume writes
+	CloseAfter int
+	// Webhook receives a POST with the breakerState every time breaker opens or closes
+	Webhook string
+}
+
+type breakerState struct {
+	Cluster   string `json:"cluster"`
+	Open      bool   `json:"open"`
+	Anomalies int    `json:"anomalies"`
+	Normal    int    `json:"normal"`
+	// Baseline is amount of metrics in the last snapshot that looked normal
+	Baseline int64 `json:"baseline"`
+	// LastSnapshot is the timestamp of the last recorded snapshot, retries of the same snapshot are not counted twice
+	LastSnapshot int64 `json:"last_snapshot"`
+}
+
+// circuitBreaker stops writing snapshots for clusters that return inconsistent data several times in a row.
+// That's usually a fetch problem and writing such snapshots poisons history.
+type circuitBreaker struct {
+	sync.Mutex
+	clusters map[string]*breakerState
+}
+
+var breaker = &circuitBreaker{
+	clusters: make(map[string]*breakerState),
+}
+
+func (b *circuitBreaker) get(cluster string) *breakerState {
+	s, ok := b.clusters[cluster]
+	if !ok {
+		s = &breakerState{Cluster: cluster}
+		b.clusters[cluster] = s
+	}
+	return s
+}
+
+func isAnomalous(baseline, metrics int64) bool {
+	if baseline == 0 {
+		return false
+	}
+	change := float64(metrics-baseline) / float64(baseline)
+	return change > config.Breaker.MaxChange || change < -config.Breaker.MaxChange
+}
+
+// check records the snapshot and returns true if it can be written
+func (b *circuitBreaker) check(cluster string, t int64, metrics int64) bool {
+	if config.Breaker.OpenAfter <= 0 {
+		return true
+	}
+
+	b.Lock()
+	s := b.get(cluster)
+	if s.LastSnapshot == t {
+		open := s.Open
+		b.Unlock()
+		return !open
+	}
+	s.LastSnapshot = t
+	wasOpen := s.Open
+	if isAnomalous(s.Baseline, metrics) {
+		s.Anomalies++
+		s.Normal = 0
+		if s.Anomalies >= config.Breaker.OpenAfter {
+			s.Open = true
+		}
+	} else {
+		s.Normal++
+		s.Anomalies = 0
+		s.Baseline = metrics
+		if s.Normal >= config.Breaker.CloseAfter {
+			s.Open = false
+		}
+	}
+	state := *s
+	b.Unlock()
+
+	b.persist(state, t)
+	if state.Open != wasOpen {
+		logger.Warn("circuit breaker state changed",
+			zap.String("cluster", cluster),
+			zap.Bool("open", state.Open),
+			zap.Int64("metrics", metrics),
+			zap.Int64("baseline", state.Baseline),
+		)
+		go notifyBreakerWebhook(state)
+	}
+	return !state.Open
+}
+
+// reset closes the breaker for the cluster and forgets its baseline
+func (b *circuitBreaker) reset(cluster string) {
+	b.Lock()
+	b.clusters[cluster] = &breakerState{Cluster: cluster}
+	state := *b.clusters[cluster]
+	b.Unlock()
+
+	b.persist(state, time.Now().Unix())
+	go notifyBreakerWebhook(state)
+}
+
+func (b *circuitBreaker) persist(state breakerState, t int64) {
+	if config.DryRun {
+		return
+	}
+	data, _ := json.Marshal(state)
+	err := sendSnapshotMetadata(breakerGraphType, state.Cluster, t, map[string]string{"state": string(data)})
+	if err != nil {
+		logger.Error("failed to persist circuit breaker state",
+			zap.String("cluster", state.Cluster),
+			zap.Error(err),
+		)
+	}
+}
+
+// load restores the latest persisted state of every cluster
+func (b *circuitBreaker) load() error {
+	rows, err := config.db.Query("SELECT cluster, argMax(value, timestamp) FROM flamegraph_metadata WHERE graph_type=? AND key='state' GROUP BY cluster", breakerGraphType)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	b.Lock()
+	defer b.Unlock()
+	for rows.Next() {
+		var cluster, value string
+		err = rows.Scan(&cluster, &value)
+		if err != nil {
+			return err
+		}
+		s := &breakerState{}
+		err = json.Unmarshal([]byte(value), s)
+		if err != nil {
+			logger.Error("failed to parse circuit breaker state",
+				zap.String("cluster", cluster),
+				zap.Error(err),
+			)
+			continue
+		}
+		s.Cluster = cluster
+		b.clusters[cluster] = s
+	}
+	return rows.Err()
+}
+
+func notifyBreakerWebhook(state breakerState) {
+	if config.Breaker.Webhook == "" {
+		return
+	}
+	data, _ := json.Marshal(state)
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Post(config.Breaker.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logger.Error("failed to call circuit breaker webhook",
+			zap.String("cluster", state.Cluster),
+			zap.Error(err),
+		)
+		return
+	}
+	resp.Body.Close()
+}
+
+// breakerHandler shows state of all breakers, POST with 'cluster' resets the breaker for that cluster. Reset lets
+// snapshots back into history, so only clients listed in AdminIdentities can do it.
+func breakerHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		if denyNonAdmin(w, req) {
+			return
+		}
+		cluster := req.FormValue("cluster")
+		if cluster == "" {
+			http.Error(w, "'cluster' must be specified", http.StatusBadRequest)
+			return
+		}
+		breaker.reset(cluster)
+		logger.Info("circuit breaker reset",
+			zap.String("cluster", cluster),
+			zap.String("identity", clientIdentity(req)),
+		)
+	}
+
+	breaker.Lock()
+	states := make([]breakerState, 0, len(breaker.clusters))
+	for _, s := range breaker.clusters {
+		states = append(states, *s)
+	}
+	breaker.Unlock()
+
+	b, err := json.Marshal(states)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
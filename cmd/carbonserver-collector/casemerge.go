@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+)
+
+// caseMerges counts metrics merged into a differently-cased duplicate per cluster
+var caseMerges = expvar.NewMap("case_merges")
+
+const caseMergeTopPrefixes = 10
+
+type mergedPrefix struct {
+	Prefix string
+	Count  int64
+}
+
+type caseMergeStats struct {
+	Merged      int64
+	TopPrefixes []mergedPrefix
+}
+
+func (s caseMergeStats) prefixesString() string {
+	res := make([]string, 0, len(s.TopPrefixes))
+	for _, p := range s.TopPrefixes {
+		res = append(res, p.Prefix+"="+strconv.FormatInt(p.Count, 10))
+	}
+	return strings.Join(res, ",")
+}
+
+// divergingPrefix returns canonical name up to and including the first path element where name differs from it
+func divergingPrefix(canonical, name string) string {
+	c := strings.Split(canonical, ".")
+	n := strings.Split(name, ".")
+	for i := range c {
+		if i >= len(n) || c[i] != n[i] {
+			return strings.Join(c[:i+1], ".")
+		}
+	}
+	return canonical
+}
+
+// mergeCaseDuplicates merges metrics whose names differ only by case. Casing reported by the most hosts is kept,
+// ties are resolved by picking the lexicographically smallest name so results are stable between runs.
+// Merged entries are combined the same way as replicas in getDetails.
+func mergeCaseDuplicates(details *pb.MetricDetailsResponse, hosts map[string]int64) caseMergeStats {
+	variants := make(map[string][]string)
+	for m := range details.Metrics {
+		l := strings.ToLower(m)
+		variants[l] = append(variants[l], m)
+	}
+
+	var stats caseMergeStats
+	prefixes := make(map[string]int64)
+	for _, names := range variants {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if hosts[names[i]] != hosts[names[j]] {
+				return hosts[names[i]] > hosts[names[j]]
+			}
+			return names[i] < names[j]
+		})
+
+		canonical := details.Metrics[names[0]]
+		for _, name := range names[1:] {
+			v := details.Metrics[name]
+			if v.ModTime > canonical.ModTime {
+				canonical.ModTime = v.ModTime
+			}
+			if v.Size_ > canonical.Size_ {
+				canonical.Size_ = v.Size_
+			}
+			delete(details.Metrics, name)
+
+			stats.Merged++
+			prefixes[divergingPrefix(names[0], name)]++
+		}
+	}
+
+	for p, cnt := range prefixes {
+		stats.TopPrefixes = append(stats.TopPrefixes, mergedPrefix{Prefix: p, Count: cnt})
+	}
+	sort.Slice(stats.TopPrefixes, func(i, j int) bool {
+		if stats.TopPrefixes[i].Count != stats.TopPrefixes[j].Count {
+			return stats.TopPrefixes[i].Count > stats.TopPrefixes[j].Count
+		}
+		return stats.TopPrefixes[i].Prefix < stats.TopPrefixes[j].Prefix
+	})
+	if len(stats.TopPrefixes) > caseMergeTopPrefixes {
+		stats.TopPrefixes = stats.TopPrefixes[:caseMergeTopPrefixes]
+	}
+
+	return stats
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// deltaGraphType stores difference between a snapshot and the one taken a day before it. Value can't be negative
+// in the UI, so growth is stored in value and shrinkage in value_negative.
+const deltaGraphType = "graphite_metrics_delta_1d"
+
+const deltaPeriod = 24 * time.Hour
+
+type deltaNode struct {
+	id       int64
+	parentID int64
+	level    int64
+	children []int64
+
+	value    int64
+	negative int64
+}
+
+// previousSnapshot returns timestamp of the latest snapshot that is at least deltaPeriod older than t, 0 if there is none
+func previousSnapshot(cluster string, t int64) (int64, error) {
+	rows, err := config.db.Query("SELECT max(timestamp) FROM new_flamegraph_timestamps WHERE graph_type='graphite_metrics' AND cluster=? AND timestamp <= ?", cluster, t-int64(deltaPeriod.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ts := int64(0)
+	for rows.Next() {
+		err = rows.Scan(&ts)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return ts, rows.Err()
+}
+
+// getSnapshotPaths returns value of every node up to DeltaMaxLevel keyed by its full path
+func getSnapshotPaths(cluster string, t int64) (map[string]int64, error) {
+	rows, err := config.db.Query("SELECT id, any(parent_id), any(name), sum(value) FROM flamegraph WHERE graph_type='graphite_metrics' AND cluster=? AND timestamp=? AND date=toDate(?) AND level < ? GROUP BY id", cluster, t, t, config.DeltaMaxLevel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type row struct {
+		parentID int64
+		name     string
+		value    int64
+	}
+	nodes := make(map[int64]row)
+	for rows.Next() {
+		var id int64
+		var r row
+		err = rows.Scan(&id, &r.parentID, &r.name, &r.value)
+		if err != nil {
+			return nil, err
+		}
+		nodes[id] = r
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Ids are assigned per snapshot, so the only thing that can be matched between snapshots is the path
+	paths := make(map[string]int64, len(nodes))
+	for id, r := range nodes {
+		parts := []string{r.name}
+		for p := r.parentID; p != 0 && p != id; {
+			parent, ok := nodes[p]
+			if !ok {
+				break
+			}
+			parts = append(parts, parent.name)
+			p = parent.parentID
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		paths[strings.Join(parts, "\x00")] = r.value
+	}
+	return paths, nil
+}
+
+// buildDeltaTree aligns two snapshots by path and returns nodes of the delta tree keyed by path
+func buildDeltaTree(cur, prev map[string]int64) map[string]*deltaNode {
+	nodes := make(map[string]*deltaNode)
+	cnt := types.RootElementId + 1
+
+	var add func(path string) *deltaNode
+	add = func(path string) *deltaNode {
+		if n, ok := nodes[path]; ok {
+			return n
+		}
+		n := &deltaNode{}
+		if idx := strings.LastIndex(path, "\x00"); idx != -1 {
+			parent := add(path[:idx])
+			n.id = cnt
+			cnt++
+			n.parentID = parent.id
+			n.level = parent.level + 1
+			parent.children = append(parent.children, n.id)
+		} else {
+			n.id = types.RootElementId
+		}
+
+		d := cur[path] - prev[path]
+		if d >= 0 {
+			n.value = d
+		} else {
+			n.negative = -d
+		}
+		nodes[path] = n
+		return n
+	}
+
+	for path := range cur {
+		add(path)
+	}
+	for path := range prev {
+		add(path)
+	}
+	return nodes
+}
+
+// storeDelta computes delta between snapshot t and a day before it and stores it as deltaGraphType at timestamp t
+func storeDelta(cluster string, t int64) error {
+	prevTs, err := previousSnapshot(cluster, t)
+	if err != nil || prevTs == 0 {
+		return err
+	}
+
+	t0 := time.Now()
+	cur, err := getSnapshotPaths(cluster, t)
+	if err != nil {
+		return err
+	}
+	prev, err := getSnapshotPaths(cluster, prevTs)
+	if err != nil {
+		return err
+	}
+	if len(cur) == 0 {
+		return nil
+	}
+	nodes := buildDeltaTree(cur, prev)
+
+	total := int64(0)
+	for path, n := range nodes {
+		if n.id == types.RootElementId {
+			total = cur[path]
+		}
+	}
+
+	now := time.Now()
+	tx, stmt, err := helper.DBStartTransaction(config.db, "INSERT INTO flamegraph (timestamp, graph_type, cluster, id, name, total, value, value_negative, parent_id, children_ids, level, mtime, date, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	for path, n := range nodes {
+		name := path[strings.LastIndex(path, "\x00")+1:]
+		_, err = stmt.Exec(
+			t,
+			deltaGraphType,
+			cluster,
+			n.id,
+			name,
+			total,
+			n.value,
+			n.negative,
+			n.parentID,
+			clickhouse.Array(n.children),
+			n.level,
+			int64(0),
+			time.Unix(t, 0),
+			uint64(now.Unix()),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	tx, stmt, err = helper.DBStartTransaction(config.db, "INSERT INTO new_flamegraph_timestamps (graph_type, cluster, timestamp, date) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(deltaGraphType, cluster, t, time.Unix(t, 0))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("delta stored",
+		zap.String("cluster", cluster),
+		zap.Int64("timestamp", t),
+		zap.Int64("previous_timestamp", prevTs),
+		zap.Int("nodes", len(nodes)),
+		zap.Duration("runtime", time.Since(t0)),
+	)
+	return nil
+}
+
+// runDeltas stores day-over-day deltas for the snapshot taken at t
+func runDeltas(t int64) {
+	for _, cluster := range config.Clusters {
+		if cluster.Interval != 0 {
+			// Taken at their own times, runScheduledCluster stores their deltas
+			continue
+		}
+		err := storeDelta(cluster.Name, t)
+		if err != nil {
+			logger.Error("failed to store delta",
+				zap.String("cluster", cluster.Name),
+				zap.Error(err),
+			)
+		}
+	}
+}
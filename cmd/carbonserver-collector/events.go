@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// snapshotEvent is sent to /events subscribers once a snapshot is complete, i.e. its timestamp is written
+type snapshotEvent struct {
+	ID         int64             `json:"id"`
+	Cluster    string            `json:"cluster"`
+	Timestamp  int64             `json:"timestamp"`
+	GraphTypes []string          `json:"graph_types"`
+	Metrics    int               `json:"metrics"`
+	Nodes      int64             `json:"nodes"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	// Link is a flamegraph-server request for the snapshot
+	Link string `json:"link"`
+}
+
+// eventFeed keeps the last EventsBufferSize events, so clients can catch up after reconnect. Ids only grow,
+// but they start over after restart, clients that see a reset event should resync with /timestamps.
+type eventFeed struct {
+	sync.Mutex
+	nextID      int64
+	events      []snapshotEvent
+	subscribers map[chan struct{}]struct{}
+}
+
+var events = &eventFeed{
+	nextID:      1,
+	subscribers: make(map[chan struct{}]struct{}),
+}
+
+func (f *eventFeed) publish(e snapshotEvent) {
+	f.Lock()
+	defer f.Unlock()
+	e.ID = f.nextID
+	f.nextID++
+	f.events = append(f.events, e)
+	if len(f.events) > config.EventsBufferSize {
+		f.events = f.events[len(f.events)-config.EventsBufferSize:]
+	}
+	for ch := range f.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// since returns events after the cursor. gap is set if some of them were already dropped from the buffer.
+func (f *eventFeed) since(cursor int64) (res []snapshotEvent, gap bool) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.events) > 0 && cursor < f.events[0].ID-1 {
+		gap = true
+	}
+	if cursor >= f.nextID {
+		// Cursor from before restart
+		gap = true
+		cursor = 0
+	}
+	for _, e := range f.events {
+		if e.ID > cursor {
+			res = append(res, e)
+		}
+	}
+	return res, gap
+}
+
+// subscribe returns a channel that is notified about new events, or false if there are EventsMaxClients already
+func (f *eventFeed) subscribe() (chan struct{}, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.subscribers) >= config.EventsMaxClients {
+		return nil, false
+	}
+	ch := make(chan struct{}, 1)
+	f.subscribers[ch] = struct{}{}
+	return ch, true
+}
+
+func (f *eventFeed) unsubscribe(ch chan struct{}) {
+	f.Lock()
+	delete(f.subscribers, ch)
+	f.Unlock()
+}
+
+// publishSnapshots emits events for clusters whose snapshots were written at t
+func publishSnapshots(clusters []*types.Cluster, results []clusterResult, t int64) {
+	for i, c := range clusters {
+		if results[i].skipped || results[i].failed {
+			continue
+		}
+		graphType := c.GraphType()
+		events.publish(snapshotEvent{
+			Cluster:    c.Name,
+			Timestamp:  t,
+			GraphTypes: []string{graphType},
+			Metrics:    results[i].metrics,
+			Nodes:      results[i].nodes,
+			Metadata:   results[i].metadata,
+			Link: "/get?" + url.Values{
+				"cluster":    {c.Name},
+				"ts":         {strconv.FormatInt(t, 10)},
+				"graph_type": {graphType},
+			}.Encode(),
+		})
+	}
+}
+
+// eventsHandler streams completed snapshots as Server-Sent Events. Clients resume with ?since=<id> or the
+// Last-Event-ID header that browsers send on reconnect.
+func eventsHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	cursorStr := req.FormValue("since")
+	if cursorStr == "" {
+		cursorStr = req.Header.Get("Last-Event-ID")
+	}
+	cursor := int64(-1)
+	if cursorStr != "" {
+		var err error
+		cursor, err = strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil || cursor < 0 {
+			http.Error(w, "Error parsing 'since'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	notify, ok := events.subscribe()
+	if !ok {
+		http.Error(w, "too many subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer events.unsubscribe(notify)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if cursor < 0 {
+		// New subscribers without a cursor only get events from now on
+		events.Lock()
+		cursor = events.nextID - 1
+		events.Unlock()
+	}
+
+	heartbeat := time.NewTicker(config.EventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		pending, gap := events.since(cursor)
+		if gap {
+			fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+		}
+		for _, e := range pending {
+			data, err := json.Marshal(e)
+			if err != nil {
+				logger.Error("failed to marshal event",
+					zap.Error(err),
+				)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: snapshot\ndata: %s\n\n", e.ID, data)
+			cursor = e.ID
+		}
+		if gap && len(pending) == 0 {
+			events.Lock()
+			cursor = events.nextID - 1
+			events.Unlock()
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-notify:
+		case <-heartbeat.C:
+			// Comments keep proxies from closing idle connections
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
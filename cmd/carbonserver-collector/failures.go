@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+)
+
+// handlerPanics counts panics in handlers of the status endpoints
+var handlerPanics = expvar.NewInt("handler_panics")
+
+// clusterFailure is sent to FailureWebhook when a cluster fails, after all retries
+type clusterFailure struct {
+	Cluster string    `json:"cluster"`
+	Time    time.Time `json:"time"`
+	// Panic and Stack are set if processing of the cluster panicked
+	Panic string `json:"panic,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+func notifyFailure(cluster string, res clusterResult) {
+	if config.FailureWebhook == "" {
+		return
+	}
+	data, _ := json.Marshal(clusterFailure{
+		Cluster: cluster,
+		Time:    time.Now(),
+		Panic:   res.panic,
+		Stack:   res.stack,
+	})
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Post(config.FailureWebhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logger.Error("failed to call failure webhook",
+			zap.String("cluster", cluster),
+			zap.Error(err),
+		)
+		return
+	}
+	resp.Body.Close()
+}
+
+// recoverPanic turns a panic in a handler into 500 with id of the request, instead of a silently dropped connection
+func recoverPanic(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				handlerPanics.Add(1)
+				id := helper.RequestID(r)
+				logger.Error("panic while serving request",
+					zap.String("uri", r.RequestURI),
+					zap.String("request_id", id),
+					zap.Any("panic", rec),
+					zap.Int("http_code", http.StatusInternalServerError),
+					zap.Stack("stack"),
+				)
+				w.Header().Set(helper.RequestIDHeader, id)
+				http.Error(w, "Internal server error, request id "+id, http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
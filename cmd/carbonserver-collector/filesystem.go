@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const whisperExt = ".wsp"
+
+// skippedFiles counts files and directories per cluster that couldn't be read during a filesystem walk
+var skippedFiles = expvar.NewMap("skipped_files")
+
+// whisperMetricName turns "foo/bar/baz.wsp" relative to the root into "foo.bar.baz"
+func whisperMetricName(rel string) string {
+	return strings.Replace(strings.TrimSuffix(rel, whisperExt), string(filepath.Separator), ".", -1)
+}
+
+// getFilesystemDetails walks whisper files under Filesystem.Root. Files and directories that can't be read are
+// skipped and logged, the snapshot is still built out of the rest. Only an unreadable root fails the walk.
+// There is no free space to report, so TotalSpace is what the metrics occupy.
+func getFilesystemDetails(ctx context.Context, cluster *types.Cluster) (*pb.MetricDetailsResponse, error) {
+	src := &cluster.Filesystem
+	root := filepath.Clean(src.Root)
+	response := &pb.MetricDetailsResponse{
+		Metrics: make(map[string]*pb.MetricDetails),
+	}
+
+	skipped := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			skipped++
+			logger.Warn("failed to read, skipping",
+				zap.String("cluster", cluster.Name),
+				zap.String("path", path),
+				zap.Error(err),
+			)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), whisperExt) {
+			return nil
+		}
+
+		var info os.FileInfo
+		if d.Type()&os.ModeSymlink != 0 {
+			if !src.FollowSymlinks {
+				return nil
+			}
+			info, err = os.Stat(path)
+			if err == nil && !info.Mode().IsRegular() {
+				return nil
+			}
+		} else if d.Type().IsRegular() {
+			info, err = d.Info()
+		} else {
+			return nil
+		}
+		if err != nil {
+			skipped++
+			logger.Warn("failed to stat, skipping",
+				zap.String("cluster", cluster.Name),
+				zap.String("path", path),
+				zap.Error(err),
+			)
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		response.Metrics[whisperMetricName(rel)] = &pb.MetricDetails{
+			Size_:   info.Size(),
+			ModTime: info.ModTime().Unix(),
+		}
+		response.TotalSpace += uint64(info.Size())
+		return nil
+	})
+	if skipped > 0 {
+		skippedFiles.Add(cluster.Name, int64(skipped))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// flavor describes how to get metric details out of a particular carbonserver implementation.
+// To support a new implementation, implement this interface and add it to flavors.
+type flavor interface {
+	// DetailsPath returns path and query of the url that lists all metrics with their details
+	DetailsPath() string
+	Decode(body []byte) (*pb.MetricDetailsResponse, error)
+}
+
+const autoFlavor = "auto"
+
+// defaultCarbonserverPort is used for hosts without a port in clusters without Port
+const defaultCarbonserverPort = 8080
+
+// goCarbonFlavor is go-carbon's carbonserver, it supports protobuf and is sensitive to the trailing slash
+type goCarbonFlavor struct{}
+
+func (goCarbonFlavor) DetailsPath() string {
+	return "/metrics/details/?format=protobuf"
+}
+
+func (goCarbonFlavor) Decode(body []byte) (*pb.MetricDetailsResponse, error) {
+	var res pb.MetricDetailsResponse
+	err := res.Unmarshal(body)
+	return &res, err
+}
+
+// classicFlavor is the original carbonserver that only speaks json
+type classicFlavor struct{}
+
+func (classicFlavor) DetailsPath() string {
+	return "/metrics/details?format=json"
+}
+
+func (classicFlavor) Decode(body []byte) (*pb.MetricDetailsResponse, error) {
+	var res pb.MetricDetailsResponse
+	err := json.Unmarshal(body, &res)
+	return &res, err
+}
+
+var flavors = map[string]flavor{
+	"go-carbon":            goCarbonFlavor{},
+	"carbonserver-classic": classicFlavor{},
+}
+
+// probeOrder is the order in which flavors are tried by the auto detection
+var probeOrder = []string{"go-carbon", "carbonserver-classic"}
+
+func validateFlavor(name string) error {
+	if _, ok := flavors[name]; ok || name == autoFlavor {
+		return nil
+	}
+	return fmt.Errorf("unknown flavor %v", name)
+}
+
+// flavorDetector remembers which flavor was detected for every host, so probing happens only once
+type flavorDetector struct {
+	sync.Mutex
+	hosts map[string]string
+}
+
+var detectedFlavors = &flavorDetector{
+	hosts: make(map[string]string),
+}
+
+func (d *flavorDetector) get(host string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	name, ok := d.hosts[host]
+	return name, ok
+}
+
+func (d *flavorDetector) set(host, name string) {
+	d.Lock()
+	d.hosts[host] = name
+	d.Unlock()
+}
+
+// detailsURL builds url of the flavor for the host. Port given in the host ("host:port") takes precedence over
+// the Port of the cluster, ListPath of the cluster replaces path of the flavor. Placeholders in PathPrefix and
+// ListPath are filled from metadata of the host.
+func detailsURL(cluster *types.Cluster, host types.Host, f flavor) (string, error) {
+	port := defaultCarbonserverPort
+	if cluster.Port != nil {
+		port = *cluster.Port
+	}
+	path := f.DetailsPath()
+	if cluster.ListPath != "" {
+		path = cluster.ListPath
+	}
+	path, err := host.Expand(strings.TrimSuffix(cluster.PathPrefix, "/") + path)
+	if err != nil {
+		return "", err
+	}
+	query := ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	scheme := "http"
+	if cluster.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     helper.HostWithDefaultPort(host.Address, strconv.Itoa(port)),
+		Path:     path,
+		RawQuery: query,
+	}
+	return u.String(), nil
+}
+
+// fetchFlavor gets metric details from the host with the given flavor
+func fetchFlavor(ctx context.Context, httpClient *http.Client, cluster *types.Cluster, host types.Host, f flavor) (*pb.MetricDetailsResponse, error) {
+	u, err := detailsURL(cluster, host, f)
+	if err != nil {
+		return nil, err
+	}
+	return fetchData(ctx, httpClient, u, !cluster.DisableCompression, f.Decode)
+}
+
+// fetchDetails gets metric details from the host, detecting the flavor first if needed
+func fetchDetails(ctx context.Context, httpClient *http.Client, cluster *types.Cluster, host types.Host) (*pb.MetricDetailsResponse, error) {
+	if cluster.Flavor != autoFlavor {
+		return fetchFlavor(ctx, httpClient, cluster, host, flavors[cluster.Flavor])
+	}
+
+	if name, ok := detectedFlavors.get(host.Address); ok {
+		return fetchFlavor(ctx, httpClient, cluster, host, flavors[name])
+	}
+
+	for _, name := range probeOrder {
+		data, err := fetchFlavor(ctx, httpClient, cluster, host, flavors[name])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		logger.Info("flavor detected",
+			zap.String("host", host.Address),
+			zap.String("flavor", name),
+		)
+		detectedFlavors.set(host.Address, name)
+		return data, nil
+	}
+	return nil, fmt.Errorf("failed to detect flavor of %v", host)
+}
+
+// statusHandler shows flavors that were detected for hosts with the "auto" flavor and state of ClickHouse
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	chStatus := clickhouseHealth.status()
+	detectedFlavors.Lock()
+	b, err := json.Marshal(struct {
+		DetectedFlavors map[string]string `json:"detected_flavors"`
+		Clickhouse      clickhouseStatus  `json:"clickhouse"`
+	}{
+		DetectedFlavors: detectedFlavors.hosts,
+		Clickhouse:      chStatus,
+	})
+	detectedFlavors.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// clickhouseState tracks whether ClickHouse is usable. Collector keeps running while it's not: snapshots are
+// skipped and /readyz reports it, until a ping or an insert succeeds again.
+type clickhouseState struct {
+	sync.Mutex
+	ready       bool
+	lastSuccess time.Time
+	lastError   string
+}
+
+var clickhouseHealth = &clickhouseState{}
+
+// lastSuccessfulIteration is unix time in nanoseconds of the last iteration that wrote at least one snapshot.
+// In DryRun nothing is written, so every finished iteration counts.
+var lastSuccessfulIteration int64
+
+func markIterationSuccess(t time.Time) {
+	atomic.StoreInt64(&lastSuccessfulIteration, t.UnixNano())
+}
+
+type clickhouseStatus struct {
+	Ready            bool      `json:"ready"`
+	LastSuccess      time.Time `json:"last_success"`
+	SinceLastSuccess string    `json:"since_last_success"`
+	LastError        string    `json:"last_error,omitempty"`
+}
+
+func (s *clickhouseState) success() {
+	s.Lock()
+	if !s.ready {
+		logger.Info("clickhouse is available")
+	}
+	s.ready, s.lastSuccess, s.lastError = true, time.Now(), ""
+	s.Unlock()
+}
+
+func (s *clickhouseState) failure(err error) {
+	s.Lock()
+	s.ready, s.lastError = false, err.Error()
+	s.Unlock()
+}
+
+func (s *clickhouseState) status() clickhouseStatus {
+	s.Lock()
+	defer s.Unlock()
+	res := clickhouseStatus{
+		Ready:       s.ready,
+		LastSuccess: s.lastSuccess,
+		LastError:   s.lastError,
+	}
+	if !s.lastSuccess.IsZero() {
+		res.SinceLastSuccess = time.Since(s.lastSuccess).String()
+	}
+	return res
+}
+
+func pingClickhouse(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := config.db.PingContext(ctx)
+	if err != nil {
+		clickhouseHealth.failure(err)
+		return err
+	}
+	clickhouseHealth.success()
+	return nil
+}
+
+// waitForClickhouse blocks until ClickHouse answers a ping, retrying with exponential backoff. It returns false
+// if ctx was canceled first.
+func waitForClickhouse(ctx context.Context, initial, max time.Duration) bool {
+	backoff := initial
+	for {
+		err := pingClickhouse(max)
+		if err == nil {
+			return true
+		}
+		fields := []zapcore.Field{
+			zap.Duration("retry_in", backoff),
+			zap.Error(err),
+		}
+		if exception, ok := err.(*clickhouse.Exception); ok {
+			fields = append(fields,
+				zap.Int32("code", exception.Code),
+				zap.String("message", exception.Message),
+			)
+		}
+		logger.Warn("clickhouse is not available", fields...)
+		if !sleepContext(ctx, backoff) {
+			return false
+		}
+		backoff *= 2
+		if backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// keepClickhouseAlive pings ClickHouse between iterations, so its state on /readyz is up to date
+func keepClickhouseAlive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		err := pingClickhouse(interval)
+		if err != nil {
+			logger.Warn("background ping of clickhouse failed",
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// healthzHandler reports that the process is alive, it doesn't depend on ClickHouse
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyHandler reports whether at least one iteration has written snapshots to ClickHouse
+func readyHandler(w http.ResponseWriter, req *http.Request) {
+	res := struct {
+		Ready                   bool             `json:"ready"`
+		LastSuccessfulIteration *time.Time       `json:"last_successful_iteration,omitempty"`
+		Clickhouse              clickhouseStatus `json:"clickhouse"`
+	}{
+		Clickhouse: clickhouseHealth.status(),
+	}
+	if ns := atomic.LoadInt64(&lastSuccessfulIteration); ns != 0 {
+		t := time.Unix(0, ns)
+		res.Ready, res.LastSuccessfulIteration = true, &t
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// readyzHandler reports whether the first iteration has succeeded and snapshots can be stored right now
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt64(&lastSuccessfulIteration) == 0 {
+		http.Error(w, "no successful iteration yet", http.StatusServiceUnavailable)
+		return
+	}
+	if !clickhouseHealth.status().Ready {
+		http.Error(w, "clickhouse is not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// skippedHosts counts hosts per cluster that weren't fetched because they are marked unhealthy
+var skippedHosts = expvar.NewMap("skipped_hosts")
+
+type hostHealthConfig struct {
+	// UnhealthyAfter consecutive failed fetches mark the host unhealthy, 0 disables tracking
+	UnhealthyAfter int
+	// SkipFor is how long an unhealthy host is skipped before it's probed again
+	SkipFor time.Duration
+}
+
+type hostState struct {
+	Host                string    `json:"host"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	SkipUntil           time.Time `json:"skip_until,omitempty"`
+}
+
+// hostHealth remembers fetch failures of hosts across iterations. A dead host otherwise costs all retries and
+// timeouts on every iteration of every cluster it's in.
+type hostHealth struct {
+	sync.Mutex
+	hosts map[string]*hostState
+}
+
+var hostsHealth = &hostHealth{
+	hosts: make(map[string]*hostState),
+}
+
+func (h *hostHealth) get(host string) *hostState {
+	s, ok := h.hosts[host]
+	if !ok {
+		s = &hostState{Host: host, Healthy: true}
+		h.hosts[host] = s
+	}
+	return s
+}
+
+// allow reports whether the host should be fetched. Once SkipFor of an unhealthy host is over, a single probe is
+// let through and the host is skipped for another SkipFor unless the probe succeeds.
+func (h *hostHealth) allow(host string, now time.Time) bool {
+	if config.HostHealth.UnhealthyAfter <= 0 {
+		return true
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(host)
+	if s.Healthy {
+		return true
+	}
+	if now.Before(s.SkipUntil) {
+		return false
+	}
+	s.SkipUntil = now.Add(config.HostHealth.SkipFor)
+	logger.Info("probing unhealthy host",
+		zap.String("host", host),
+		zap.Int("consecutive_failures", s.ConsecutiveFailures),
+	)
+	return true
+}
+
+// record updates the host state with the result of a fetch
+func (h *hostHealth) record(host string, err error, now time.Time) {
+	if config.HostHealth.UnhealthyAfter <= 0 {
+		return
+	}
+
+	h.Lock()
+	s := h.get(host)
+	wasHealthy := s.Healthy
+	if err == nil {
+		s.Healthy = true
+		s.ConsecutiveFailures = 0
+		s.LastError = ""
+		s.SkipUntil = time.Time{}
+	} else {
+		s.ConsecutiveFailures++
+		s.LastError = err.Error()
+		if s.Healthy && s.ConsecutiveFailures >= config.HostHealth.UnhealthyAfter {
+			s.Healthy = false
+			s.SkipUntil = now.Add(config.HostHealth.SkipFor)
+		}
+	}
+	state := *s
+	h.Unlock()
+
+	if state.Healthy != wasHealthy {
+		logger.Warn("host health changed",
+			zap.String("host", host),
+			zap.Bool("healthy", state.Healthy),
+			zap.Int("consecutive_failures", state.ConsecutiveFailures),
+			zap.Time("skip_until", state.SkipUntil),
+			zap.String("last_error", state.LastError),
+		)
+	}
+}
+
+func (h *hostHealth) states() []hostState {
+	h.Lock()
+	defer h.Unlock()
+	res := make([]hostState, 0, len(h.hosts))
+	for _, s := range h.hosts {
+		res = append(res, *s)
+	}
+	return res
+}
+
+// hostHealthHandler shows state of every host that was fetched at least once
+func hostHealthHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(hostsHealth.states())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -1,21 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"runtime/debug"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"database/sql"
@@ -24,11 +32,20 @@ import (
 	"github.com/Civil/ch-flamegraphs/types"
 	ecache "github.com/dgryski/go-expirecache"
 	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
-	"github.com/kshvakov/clickhouse"
 )
 
 var logger *zap.Logger
 
+// panics counts recovered panics per cluster
+var panics = expvar.NewMap("panics")
+var clusterRetries = expvar.NewMap("cluster_retries")
+
+// failedHosts counts hosts per cluster that couldn't be fetched after all retries
+var failedHosts = expvar.NewMap("failed_hosts")
+
+// quorumFailures counts snapshots that were not written because less than MinHostsSuccess hosts responded
+var quorumFailures = expvar.NewMap("quorum_failures")
+
 // Copied from github.com/dgryski/carbonapi
 
 type limiter chan struct{}
@@ -42,7 +59,8 @@ func newLimiter(l int) limiter {
 
 // End of copy from carbonapi
 
-func constructTree(root *types.FlameGraphNode, details *pb.MetricDetailsResponse) {
+// constructTree builds the tree out of metric details. It gives up if heap grows over MemoryLimitMB
+func constructTree(root *types.FlameGraphNode, details *pb.MetricDetailsResponse) error {
 	cnt := types.RootElementId + 2
 	total := uint64(details.TotalSpace)
 	occupiedByMetrics := uint64(0)
@@ -50,12 +68,20 @@ func constructTree(root *types.FlameGraphNode, details *pb.MetricDetailsResponse
 	var seenSoFar string
 	var seenSoFarPrev string
 
+	processed := 0
 	for metric, data := range details.Metrics {
+		processed++
+		if processed%helper.MemoryCheckInterval == 0 {
+			if err := helper.CheckMemoryLimit(config.MemoryLimitMB); err != nil {
+				return err
+			}
+		}
 		occupiedByMetrics += uint64(data.Size_)
 		seenSoFar = ""
-		parts := strings.Split(metric, ".")
-		l := len(parts) - 1
-		for i, part := range parts {
+		parts := config.parser.ParsePath(metric)
+		// Every node on the path accounts the metric: Value is the sum of sizes and Count is the amount of
+		// metrics under the node. Empty parts ("a..b", "a.b.") are skipped, so such metrics land on "a.b".
+		for _, part := range parts {
 			if part == "" {
 				continue
 			}
@@ -81,16 +107,12 @@ func constructTree(root *types.FlameGraphNode, details *pb.MetricDetailsResponse
 					parent = root
 				}
 
-				v := int64(0)
-				if i == l {
-					v = int64(data.Size_)
-				}
-
 				m := &types.FlameGraphNode{
 					Id:      cnt,
 					Cluster: parent.Cluster,
 					Name:    part,
-					Value:   v,
+					Count:   1,
+					Value:   int64(data.Size_),
 					ModTime: data.ModTime,
 					RdTime:  data.RdTime,
 					ATime:   data.ATime,
@@ -105,7 +127,9 @@ func constructTree(root *types.FlameGraphNode, details *pb.MetricDetailsResponse
 		}
 	}
 
-	if occupiedByMetrics+details.FreeSpace < total {
+	if occupiedByMetrics+details.FreeSpace == total {
+		// Everything is accounted for, e.g. for sources that don't report disk usage
+	} else if occupiedByMetrics+details.FreeSpace < total {
 		occupiedByRest := total - occupiedByMetrics - details.FreeSpace
 		m := &types.FlameGraphNode{
 			Id:      cnt,
@@ -127,6 +151,85 @@ func constructTree(root *types.FlameGraphNode, details *pb.MetricDetailsResponse
 			zap.Uint64("total_space", details.TotalSpace),
 		)
 	}
+	return nil
+}
+
+const (
+	// totalModeGlobal sets Total of every node to the size of the disk, percentages are relative to the whole cluster
+	totalModeGlobal = "global"
+	// totalModeSubtree sets Total of every node but the root to its own value, so nested percentages are
+	// relative to the parent
+	totalModeSubtree = "subtree"
+)
+
+// applyTotalMode rewrites Total of the nodes below the root according to TotalMode. Root keeps the size of
+// the disk in either mode, as servers take the total of the snapshot from it.
+func applyTotalMode(root *types.FlameGraphNode) {
+	if config.TotalMode != totalModeSubtree {
+		return
+	}
+	var walk func(n *types.FlameGraphNode)
+	walk = func(n *types.FlameGraphNode) {
+		for _, c := range n.Children {
+			c.Total = c.Value
+			walk(c)
+		}
+	}
+	walk(root)
+}
+
+// validateTree checks that children of every node don't add up to more than the node itself and logs a warning
+// with the amount of nodes where they do
+func validateTree(root *types.FlameGraphNode) {
+	violations := 0
+	var first *types.FlameGraphNode
+	var walk func(n *types.FlameGraphNode)
+	walk = func(n *types.FlameGraphNode) {
+		sum := int64(0)
+		for _, c := range n.Children {
+			sum += c.Value
+			walk(c)
+		}
+		if sum > n.Value {
+			violations++
+			if first == nil {
+				first = n
+			}
+		}
+	}
+	walk(root)
+
+	if violations > 0 {
+		logger.Warn("children of nodes add up to more than their parents",
+			zap.String("cluster", root.Cluster),
+			zap.Int("nodes", violations),
+			zap.String("first_node", first.Name),
+			zap.Int64("first_node_value", first.Value),
+		)
+	}
+}
+
+// warnIfEverythingTrimmed logs a warning if RemoveLowestPct is so high that only the root would survive the trimming
+func warnIfEverythingTrimmed(root *types.FlameGraphNode) {
+	if config.RemoveLowestPct <= 0 || root.Value <= 0 {
+		return
+	}
+
+	largest := int64(0)
+	for _, n := range root.Children {
+		if n.Value > largest {
+			largest = n.Value
+		}
+	}
+
+	largestPct := 100 * float64(largest) / float64(root.Value)
+	if largestPct <= config.RemoveLowestPct {
+		logger.Warn("RemoveLowestPct would trim the entire tree",
+			zap.String("cluster", root.Cluster),
+			zap.Float64("remove_lowest_pct", config.RemoveLowestPct),
+			zap.Float64("largest_child_pct", largestPct),
+		)
+	}
 }
 
 func updateKnownClusters(clusters []string) error {
@@ -157,6 +260,80 @@ func updateKnownClusters(clusters []string) error {
 	return nil
 }
 
+// BuildVersion is defined at build and stored with every snapshot
+var BuildVersion = "(development version)"
+
+// configHash returns a hash of the settings that affect how the tree is built, so readers can tell
+// if two snapshots were built in a compatible way
+func configHash(cluster *types.Cluster) string {
+	settings := struct {
+		PathParser          string
+		RemoveLowestPct     float64
+		MinValue            int64
+		MergeCaseDuplicates bool
+		QueryPrefixes       []string
+		TotalMode           string `json:",omitempty"`
+	}{
+		PathParser:          config.PathParser,
+		RemoveLowestPct:     config.RemoveLowestPct,
+		MinValue:            cluster.MinValue,
+		MergeCaseDuplicates: cluster.MergeCaseDuplicates,
+		QueryPrefixes:       cluster.QueryPrefixes,
+	}
+	if cluster.RemoveLowestPct != 0 {
+		settings.RemoveLowestPct = cluster.RemoveLowestPct
+	}
+	// Snapshots built before TotalMode existed are global, the hash stays the same for them
+	if config.TotalMode != totalModeGlobal {
+		settings.TotalMode = config.TotalMode
+	}
+
+	b, _ := json.Marshal(settings)
+	return strconv.FormatUint(helper.NameToIdUint64(string(b)), 16)
+}
+
+// snapshotMetadata returns metadata that will be stored alongside the snapshot
+func snapshotMetadata(cluster *types.Cluster) map[string]string {
+	metadata := map[string]string{
+		"tool_version": BuildVersion,
+		"config_hash":  configHash(cluster),
+	}
+	if len(cluster.QueryPrefixes) > 0 {
+		metadata["query_prefixes"] = strings.Join(cluster.QueryPrefixes, ",")
+	}
+	if s := skew.metadata(); s != "" {
+		metadata[clockSkewKey] = s
+	}
+	return metadata
+}
+
+func sendSnapshotMetadata(graphType, cluster string, t int64, metadata map[string]string) error {
+	now := time.Now()
+
+	tx, stmt, err := helper.DBStartTransaction(config.db, "INSERT INTO flamegraph_metadata (graph_type, cluster, timestamp, key, value, date, version) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	for k, v := range metadata {
+		_, err := stmt.Exec(
+			graphType,
+			cluster,
+			t,
+			k,
+			v,
+			now,
+			uint64(now.Unix()),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func updateTimestamps(clusters []types.Cluster, t int64) error {
 	logger.Info("Sending timestamps to clickhouse")
 	now := time.Now()
@@ -168,7 +345,7 @@ func updateTimestamps(clusters []types.Cluster, t int64) error {
 
 	for _, cluster := range clusters {
 		_, err := stmt.Exec(
-			"graphite_metrics",
+			cluster.GraphType(),
 			cluster.Name,
 			t,
 			now,
@@ -185,7 +362,8 @@ func updateTimestamps(clusters []types.Cluster, t int64) error {
 	return nil
 }
 
-func sendMetricsStatsToClickhouse(stats *pb.MetricDetailsResponse, t int64, cluster string) {
+// sendMetricsStatsToClickhouse returns amount of lines that were committed, they stay even if sending failed
+func sendMetricsStatsToClickhouse(stats *pb.MetricDetailsResponse, t int64, cluster string) int64 {
 	logger := logger.With(
 		zap.String("cluster", cluster),
 	)
@@ -198,7 +376,7 @@ func sendMetricsStatsToClickhouse(stats *pb.MetricDetailsResponse, t int64, clus
 		logger.Error("failed to initialize sender",
 			zap.Error(err),
 		)
-		return
+		return 0
 	}
 
 	id := int64(0)
@@ -209,21 +387,42 @@ func sendMetricsStatsToClickhouse(stats *pb.MetricDetailsResponse, t int64, clus
 			logger.Error("failed to execute statement",
 				zap.Error(err),
 			)
-			return
+			return sender.CommittedLines()
 		}
 	}
 
+	committed := sender.CommittedLines()
 	lines, err := sender.Commit()
 	if err != nil {
 		logger.Error("failed to commit",
 			zap.Error(err),
 		)
-		return
+		return committed
 	}
 	logger.Info("metrics stats written",
 		zap.String("cluster", cluster),
 		zap.Int64("lines", lines),
 	)
+	return lines
+}
+
+// cappedChildrenIds returns ids of at most MaxChildrenIds largest children and true if some of them were dropped
+func cappedChildrenIds(node *types.FlameGraphNode) ([]int64, bool) {
+	if config.MaxChildrenIds <= 0 || len(node.ChildrenIds) <= config.MaxChildrenIds {
+		return node.ChildrenIds, false
+	}
+
+	children := make([]*types.FlameGraphNode, len(node.Children))
+	copy(children, node.Children)
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Value > children[j].Value
+	})
+
+	ids := make([]int64, 0, config.MaxChildrenIds)
+	for _, c := range children[:config.MaxChildrenIds] {
+		ids = append(ids, c.Id)
+	}
+	return ids, true
 }
 
 func convertAndSendToClickhouse(sender *helper.ClickhouseSender, node *types.FlameGraphNode, level uint64) error {
@@ -231,7 +430,13 @@ func convertAndSendToClickhouse(sender *helper.ClickhouseSender, node *types.Fla
 	if node.Parent != nil {
 		parentID = node.Parent.Id
 	}
-	err := sender.SendFg(node.Cluster, node.Name, node.Id, node.ModTime, node.Total, node.Value, parentID, node.ChildrenIds, level)
+	childrenIds, truncated := cappedChildrenIds(node)
+	encoding := helper.ChildrenIdsPlain
+	if config.DeltaEncodeChildrenIds {
+		childrenIds = helper.DeltaEncodeIds(childrenIds)
+		encoding = helper.ChildrenIdsDelta
+	}
+	err := sender.SendFg(node.Cluster, node.Name, node.Id, node.ModTime, node.Total, node.Value, parentID, childrenIds, encoding, truncated, level)
 	if err != nil {
 		return err
 	}
@@ -245,95 +450,172 @@ func convertAndSendToClickhouse(sender *helper.ClickhouseSender, node *types.Fla
 	return nil
 }
 
-func sendToClickhouse(node *types.FlameGraphNode, t int64) {
+// sendToClickhouse stores the tree and returns amount of rows that were inserted. On error it returns amount of
+// rows that were committed before the failure.
+func sendToClickhouse(node *types.FlameGraphNode, graphType string, t int64) (int64, error) {
 	logger := logger.With(
 		zap.String("cluster", node.Cluster),
 	)
 	logger.Info("Sending results to clickhouse")
 
-	sender, err := helper.NewClickhouseSender(config.db, "INSERT INTO flamegraph (timestamp, graph_type, cluster, id, name, total, value, parent_id, children_ids, level, mtime, date, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", t, config.RowsPerInsert)
+	sender, err := helper.NewClickhouseSender(config.db, "INSERT INTO flamegraph (timestamp, graph_type, cluster, id, name, total, value, parent_id, children_ids, children_ids_encoding, children_truncated, level, mtime, date, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", t, config.RowsPerInsert)
 	if err != nil {
+		clickhouseHealth.failure(err)
 		logger.Error("failed to initialize sender",
 			zap.Error(err),
 		)
-		return
+		return 0, err
 	}
 
+	sender.SetGraphType(graphType)
 	err = convertAndSendToClickhouse(sender, node, 0)
 
 	if err != nil {
-		logger.Fatal("failed to send data to ClickHouse",
+		// ClickHouse may be down for maintenance, the snapshot is lost but the next iteration will try again
+		clickhouseHealth.failure(err)
+		sender.Rollback()
+		logger.Error("failed to send data to ClickHouse",
 			zap.Error(err),
 		)
-		return
+		return sender.CommittedLines(), err
 	}
+	committed := sender.CommittedLines()
 	lines, err := sender.Commit()
 	if err != nil {
-		logger.Fatal("failed to commit data to ClickHouse",
+		clickhouseHealth.failure(err)
+		logger.Error("failed to commit data to ClickHouse",
 			zap.Error(err),
 		)
-		return
+		return committed, err
 	}
+	clickhouseHealth.success()
 	logger.Info("sucessfuly sent data",
 		zap.Int64("lines", lines),
 		zap.String("cluster", node.Cluster),
 	)
+	return lines, nil
 }
 
 var errTimeout = fmt.Errorf("max tries exceeded")
 
-func fetchData(httpClient *http.Client, url string) (*pb.MetricDetailsResponse, error) {
-	var metricsResponse pb.MetricDetailsResponse
-	var response *http.Response
-	var err error
-	tries := 1
+// httpStatusError is a non-200 response. 5xx are retried, 4xx won't get better by retrying.
+type httpStatusError struct {
+	code    int
+	snippet string
+}
 
-retry:
-	if tries > 3 {
-		logger.Error("Tries exceeded while trying to fetch data",
-			zap.String("url", url),
-			zap.Int("try", tries),
-		)
-		return nil, errTimeout
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("got HTTP %v: %q", e.code, e.snippet)
+}
+
+func (e *httpStatusError) retryable() bool {
+	return e.code >= 500
+}
+
+// maxErrorSnippet is how much of an error response body ends up in logs
+const maxErrorSnippet = 256
+
+// readBody reads the response, decompressing it if it's gzipped. Some servers set Content-Encoding: gzip but
+// send the body as is, so the body itself is checked for gzip magic bytes.
+func readBody(response *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+		return body, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// fetchOnce makes a single request for metric details
+func fetchOnce(ctx context.Context, httpClient *http.Client, url string, compress bool, decode func([]byte) (*pb.MetricDetailsResponse, error)) (*pb.MetricDetailsResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Encoding is set explicitly, so the transport doesn't decompress on its own and fail on servers that
+	// send identity despite the header
+	if compress {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error during communication with client: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		snippet, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorSnippet))
+		return nil, &httpStatusError{code: response.StatusCode, snippet: string(snippet)}
 	}
-	response, err = httpClient.Get(url)
+
+	body, err := readBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading client's response: %v", err)
+	}
+
+	metricsResponse, err := decode(body)
 	if err != nil {
-		logger.Error("Error during communication with client",
+		return nil, fmt.Errorf("error while parsing client's response: %v", err)
+	}
+	if len(metricsResponse.Metrics) == 0 {
+		return nil, fmt.Errorf("client returned no metrics")
+	}
+	return metricsResponse, nil
+}
+
+// retryBackoff returns how long to wait before the retry number attempt (starting from 1): FetchRetryBackoff
+// doubled for every previous retry, capped by FetchRetryMaxBackoff, +/- FetchRetryJitter of itself
+func retryBackoff(attempt int) time.Duration {
+	backoff := config.FetchRetryBackoff
+	for i := 1; i < attempt && backoff < config.FetchRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > config.FetchRetryMaxBackoff {
+		backoff = config.FetchRetryMaxBackoff
+	}
+	if config.FetchRetryJitter > 0 {
+		backoff += time.Duration((rand.Float64()*2 - 1) * config.FetchRetryJitter * float64(backoff))
+	}
+	return backoff
+}
+
+func fetchData(ctx context.Context, httpClient *http.Client, url string, compress bool, decode func([]byte) (*pb.MetricDetailsResponse, error)) (*pb.MetricDetailsResponse, error) {
+	t0 := time.Now()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && !sleepContext(ctx, retryBackoff(attempt)) {
+			return nil, ctx.Err()
+		}
+		metricsResponse, err := fetchOnce(ctx, httpClient, url, compress, decode)
+		if err == nil {
+			return metricsResponse, nil
+		}
+		logger.Error("Error fetching data",
 			zap.String("url", url),
-			zap.Int("try", tries),
+			zap.Int("try", attempt+1),
 			zap.Error(err),
 		)
-		tries++
-		time.Sleep(300 * time.Millisecond)
-		goto retry
-	} else {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			logger.Error("Error while reading client's response",
-				zap.String("url", url),
-				zap.Int("try", tries),
-				zap.Error(err),
-			)
-			tries++
-			time.Sleep(300 * time.Millisecond)
-			goto retry
+		if statusErr, ok := err.(*httpStatusError); ok && !statusErr.retryable() {
+			return nil, err
 		}
-
-		err = metricsResponse.Unmarshal(body)
-		if err != nil || len(metricsResponse.Metrics) == 0 {
-			logger.Error("Error while parsing client's response",
+		if attempt >= config.FetchRetries {
+			// Caller reports the host as failed, this only tells how much time went into retries
+			logger.Warn("Tries exceeded while trying to fetch data",
 				zap.String("url", url),
-				zap.Int("try", tries),
-				zap.Error(err),
+				zap.Int("try", attempt+1),
+				zap.Duration("elapsed", time.Since(t0)),
 			)
-			tries++
-			time.Sleep(300 * time.Millisecond)
-			goto retry
+			return nil, fmt.Errorf("%v, last error: %v", errTimeout, err)
 		}
 	}
-
-	return &metricsResponse, nil
 }
 
 type details struct {
@@ -348,198 +630,534 @@ type metricDetails struct {
 	totalSpace int64
 }
 
-func getDetails(ips []string, cluster string) *pb.MetricDetailsResponse {
-	httpClient := &http.Client{Timeout: 120 * time.Second}
-	response := &pb.MetricDetailsResponse{
-		Metrics: make(map[string]*pb.MetricDetails),
+// getDetails fetches and deduplicates metric details from all hosts of the cluster. It also returns how many
+// additional hosts reported each metric, metrics seen on a single host are omitted, and how many hosts responded
+func getDetails(ctx context.Context, cluster *types.Cluster) (*pb.MetricDetailsResponse, map[string]int64, int) {
+	hosts := cluster.Hosts
+	httpClient := httpClients[cluster.Name]
+	if len(hosts) == 1 {
+		details, ok := getSingleHostDetails(ctx, httpClient, cluster)
+		return details, nil, ok
 	}
-	responses := make([]*pb.MetricDetailsResponse, len(ips))
+	merged := newDetailsMerger()
 	fetchingLimiter := newLimiter(config.FetchPerCluster)
 
 	var wg sync.WaitGroup
-	for idx, ip := range ips {
+	for _, host := range hosts {
 		wg.Add(1)
-		go func(i int, ip string) {
+		go func(host types.Host) {
 			fetchingLimiter.enter()
 			defer fetchingLimiter.leave()
 			defer wg.Done()
-			url := "http://" + ip + ":8080/metrics/details/?format=protobuf"
-			data, err := fetchData(httpClient, url)
+			if !hostsHealth.allow(host.Address, time.Now()) {
+				skippedHosts.Add(cluster.Name, 1)
+				logger.Debug("host is unhealthy, skipped",
+					zap.String("cluster", cluster.Name),
+					zap.String("host", host.Address),
+				)
+				return
+			}
+			data, err := fetchDetails(ctx, httpClient, cluster, host)
+			hostsHealth.record(host.Address, err, time.Now())
 			if err != nil {
-				logger.Error("timeout during fetching details",
-					zap.String("host", ip),
+				failedHosts.Add(cluster.Name, 1)
+				logger.Error("failed to fetch details",
+					zap.String("cluster", cluster.Name),
+					zap.String("host", host.Address),
+					zap.Error(err),
 				)
 				return
 			}
-			responses[i] = data
-		}(idx, ip)
+			merged.add(data)
+		}(host)
 	}
 	wg.Wait()
 
-	maxCount := int64(1)
-	metricsReplicationCounter := make(map[string]int64)
-	for idx := range responses {
-		if responses[idx] == nil {
-			continue
-		}
+	return merged.result()
+}
 
-		response.FreeSpace += responses[idx].FreeSpace
-		response.TotalSpace += responses[idx].TotalSpace
+// detailsMerger deduplicates responses of hosts of a cluster. Every response is merged as soon as it's fetched,
+// so only the unique set and responses that are still being fetched are held in memory, not a response per host.
+type detailsMerger struct {
+	sync.Mutex
+	response           *pb.MetricDetailsResponse
+	replicationCounter map[string]int64
+	maxCount           int64 // copies of the most replicated metric, disk space of hosts is divided by it
+	succeeded          int
+}
 
-		for m, v := range responses[idx].Metrics {
-			if r, ok := response.Metrics[m]; ok {
-				metricsReplicationCounter[m]++
-				if metricsReplicationCounter[m] > maxCount {
-					maxCount = metricsReplicationCounter[m]
-				}
-				if v.ModTime > r.ModTime {
-					r.ModTime = v.ModTime
-				}
-				if v.Size_ > r.Size_ {
-					r.Size_ = v.Size_
-				}
-			} else {
-				response.Metrics[m] = v
+func newDetailsMerger() *detailsMerger {
+	return &detailsMerger{
+		response: &pb.MetricDetailsResponse{
+			Metrics: make(map[string]*pb.MetricDetails),
+		},
+		replicationCounter: make(map[string]int64),
+		maxCount:           1,
+	}
+}
+
+func (d *detailsMerger) add(data *pb.MetricDetailsResponse) {
+	d.Lock()
+	defer d.Unlock()
+	d.succeeded++
+
+	d.response.FreeSpace += data.FreeSpace
+	d.response.TotalSpace += data.TotalSpace
+
+	for m, v := range data.Metrics {
+		if r, ok := d.response.Metrics[m]; ok {
+			d.replicationCounter[m]++
+			// The counter doesn't include the first copy
+			if copies := d.replicationCounter[m] + 1; copies > d.maxCount {
+				d.maxCount = copies
+			}
+			if v.ModTime > r.ModTime {
+				r.ModTime = v.ModTime
 			}
+			if v.Size_ > r.Size_ {
+				r.Size_ = v.Size_
+			}
+		} else {
+			d.response.Metrics[m] = v
 		}
 	}
+}
 
-	response.FreeSpace /= uint64(maxCount)
-	response.TotalSpace /= uint64(maxCount)
+// result returns merged response, replication counters and amount of hosts that were merged
+func (d *detailsMerger) result() (*pb.MetricDetailsResponse, map[string]int64, int) {
+	d.Lock()
+	defer d.Unlock()
+	d.response.FreeSpace /= uint64(d.maxCount)
+	d.response.TotalSpace /= uint64(d.maxCount)
+	return d.response, d.replicationCounter, d.succeeded
+}
 
-	return response
+// getSingleHostDetails is getDetails for a cluster of one host: there is nothing to deduplicate, so the response
+// is used as is, without copying it into another map
+func getSingleHostDetails(ctx context.Context, httpClient *http.Client, cluster *types.Cluster) (*pb.MetricDetailsResponse, int) {
+	host := cluster.Hosts[0]
+	if !hostsHealth.allow(host.Address, time.Now()) {
+		skippedHosts.Add(cluster.Name, 1)
+		logger.Debug("host is unhealthy, skipped",
+			zap.String("cluster", cluster.Name),
+			zap.String("host", host.Address),
+		)
+		return &pb.MetricDetailsResponse{
+			Metrics: make(map[string]*pb.MetricDetails),
+		}, 0
+	}
+	data, err := fetchDetails(ctx, httpClient, cluster, host)
+	hostsHealth.record(host.Address, err, time.Now())
+	if err != nil {
+		failedHosts.Add(cluster.Name, 1)
+		logger.Error("failed to fetch details",
+			zap.String("cluster", cluster.Name),
+			zap.String("host", host.Address),
+			zap.Error(err),
+		)
+		return &pb.MetricDetailsResponse{
+			Metrics: make(map[string]*pb.MetricDetails),
+		}, 0
+	}
+	return data, 1
 }
 
-func parseTree(cluster *types.Cluster, t int64) {
+// clusterResult is what parseTree reports for the iteration summary
+type clusterResult struct {
+	failed bool
+	// partial is set once any consumer committed rows, retrying a failed cluster would duplicate them
+	partial bool
+	// skipped is set when snapshot was fetched, but not written because circuit breaker is open or, with
+	// StoreOnStructureChange, because the set of metrics didn't change
+	skipped        bool
+	metrics        int
+	nodes          int64
+	insertDuration time.Duration
+	metadata       map[string]string
+	// panic and stack are set if processing panicked
+	panic string
+	stack string
+}
+
+// parseTree fetches metrics of the cluster and hands them to consumers. Canceling ctx aborts fetching, but
+// metrics that were already fetched are still stored, so a snapshot is never cut in the middle.
+func parseTree(ctx context.Context, cluster *types.Cluster, t int64) (res clusterResult) {
 	t0 := time.Now()
 	defer func() {
 		if r := recover(); r != nil {
-			err, ok := r.(error)
-			if !ok {
-				err = fmt.Errorf("Unknown error")
-			}
+			res.failed = true
+			res.panic = fmt.Sprint(r)
+			res.stack = string(debug.Stack())
+			panics.Add(cluster.Name, 1)
 			logger.Error("panic constructing tree",
 				zap.String("cluster", cluster.Name),
-				zap.Error(err),
+				zap.String("panic", res.panic),
 				zap.Stack("stack"),
 			)
 		}
 	}()
-	details := getDetails(cluster.Hosts, cluster.Name)
+	var details *pb.MetricDetailsResponse
+	var replicas map[string]int64
+	var hostsMetadata map[string]string
+	switch cluster.Source {
+	case types.SourcePrometheus:
+		var err error
+		details, err = getPrometheusDetails(ctx, cluster)
+		if err != nil {
+			logger.Error("failed to fetch series from prometheus",
+				zap.String("cluster", cluster.Name),
+				zap.String("url", cluster.Prometheus.URL),
+				zap.Error(err),
+			)
+		}
+	case types.SourceFilesystem:
+		var err error
+		details, err = getFilesystemDetails(ctx, cluster)
+		if err != nil {
+			logger.Error("failed to walk whisper files",
+				zap.String("cluster", cluster.Name),
+				zap.String("root", cluster.Filesystem.Root),
+				zap.Error(err),
+			)
+		}
+	default:
+		var succeeded int
+		details, replicas, succeeded = getDetails(ctx, cluster)
+		hostsMetadata = map[string]string{
+			"hosts_success": strconv.Itoa(succeeded),
+			"hosts_total":   strconv.Itoa(len(cluster.Hosts)),
+		}
+		minHosts, _ := cluster.MinHosts()
+		if succeeded < minHosts {
+			// A snapshot of a part of the cluster looks like the metric tree shrank, it's worse than no snapshot
+			quorumFailures.Add(cluster.Name, 1)
+			logger.Error("not enough hosts responded, snapshot won't be written",
+				zap.String("cluster", cluster.Name),
+				zap.Int("hosts_success", succeeded),
+				zap.Int("hosts_total", len(cluster.Hosts)),
+				zap.Int("min_hosts_success", minHosts),
+			)
+			res.failed = true
+			return res
+		}
+	}
 	if details == nil {
 		logger.Error("failed to parse tree",
 			zap.String("cluster", cluster.Name),
-			zap.Strings("hosts", cluster.Hosts),
+			zap.Strings("hosts", types.HostAddresses(cluster.Hosts)),
 		)
-		return
+		res.failed = true
+		return res
+	}
+	if len(cluster.QueryPrefixes) > 0 {
+		removed := filterPrefixes(details, cluster.QueryPrefixes)
+		logger.Debug("filtered metrics by prefixes",
+			zap.String("cluster", cluster.Name),
+			zap.Strings("prefixes", cluster.QueryPrefixes),
+			zap.Int("removed", removed),
+		)
+	}
+	res.metrics = len(details.Metrics)
+	if res.metrics == 0 {
+		// All hosts failed to respond, there is nothing to store
+		logger.Error("no metrics fetched, snapshot won't be written",
+			zap.String("cluster", cluster.Name),
+			zap.Strings("hosts", types.HostAddresses(cluster.Hosts)),
+		)
+		res.failed = true
+		return res
 	}
 
 	logger.Info("Got results",
 		zap.String("cluster", cluster.Name),
 		zap.Int("metrics", len(details.Metrics)),
+		zap.Int64("approx_bytes", approxDetailsBytes(details)),
 	)
 
 	if !config.DryRun {
-		sendMetricsStatsToClickhouse(details, t, cluster.Name)
+		if err := skew.check(); err != nil {
+			res.skipped = true
+			logger.Error("snapshot won't be written",
+				zap.String("cluster", cluster.Name),
+				zap.Error(err),
+			)
+			return res
+		}
 	}
 
-	flameGraphTreeRoot := &types.FlameGraphNode{
-		Id:      types.RootElementId,
-		Cluster: cluster.Name,
-		Name:    "[disk]",
-		Value:   0,
-		Total:   int64(details.TotalSpace),
-		Parent:  nil,
+	metadata := snapshotMetadata(cluster)
+	for k, v := range hostsMetadata {
+		metadata[k] = v
 	}
-
-	freeSpaceNode := &types.FlameGraphNode{
-		Id:      types.RootElementId + 1,
-		Cluster: cluster.Name,
-		Name:    "[free]",
-		Value:   int64(details.FreeSpace),
-		Total:   int64(details.TotalSpace),
-		Parent:  flameGraphTreeRoot,
+	if cluster.MergeCaseDuplicates {
+		stats := mergeCaseDuplicates(details, replicas)
+		caseMerges.Add(cluster.Name, stats.Merged)
+		metadata["case_merged_metrics"] = strconv.FormatInt(stats.Merged, 10)
+		metadata["case_merged_top_prefixes"] = stats.prefixesString()
+		if stats.Merged > 0 {
+			logger.Warn("merged metrics that differ only by case",
+				zap.String("cluster", cluster.Name),
+				zap.Int64("merged", stats.Merged),
+				zap.String("top_prefixes", stats.prefixesString()),
+			)
+		}
 	}
 
-	flameGraphTreeRoot.ChildrenIds = append(flameGraphTreeRoot.ChildrenIds, types.RootElementId+1)
-	flameGraphTreeRoot.Children = append(flameGraphTreeRoot.Children, freeSpaceNode)
-
-	constructTree(flameGraphTreeRoot, details)
-
-	flameGraphTreeRoot.Value = int64(details.TotalSpace)
+	if !breaker.check(cluster.Name, t, int64(len(details.Metrics))) {
+		// Keep fetching so the breaker can close, but don't let the snapshot into history
+		res.skipped = true
+		logger.Warn("circuit breaker is open, snapshot won't be written",
+			zap.String("cluster", cluster.Name),
+			zap.Int("metrics", len(details.Metrics)),
+			zap.Uint64("total_space", details.TotalSpace),
+			zap.Uint64("free_space", details.FreeSpace),
+		)
+		return res
+	}
 
-	// Convert to clickhouse format
-	if !config.DryRun {
-		sendToClickhouse(flameGraphTreeRoot, t)
-	} else {
-		data, err := json.Marshal(flameGraphTreeRoot)
-		if err != nil {
-			logger.Error("failed to marshal data to json",
-				zap.Error(err),
-			)
-		} else {
-			fmt.Printf("%v\b", string(data))
-		}
+	fetched := &fetchedMetrics{
+		cluster:  cluster,
+		t:        t,
+		details:  details,
+		replicas: replicas,
+		metadata: metadata,
+	}
+	details, replicas = nil, nil
+	res.metadata = metadata
+	err := runConsumers(fetched, &res)
+	if err != nil {
+		res.failed = true
+		logger.Error("failed to process cluster",
+			zap.String("cluster", cluster.Name),
+			zap.Int("metrics", res.metrics),
+			zap.Error(err),
+		)
+		return res
 	}
 
 	logger.Info("Finished generating graphs",
 		zap.String("cluster", cluster.Name),
 		zap.Duration("cluster_processing_time_seconds", time.Since(t0)),
 	)
+	return res
 }
 
-func processData() {
-	clusterLimiter := newLimiter(config.ClustersInParallel)
-	for {
-		t0 := time.Now()
-		logger.Info("Iteration start")
+// logIterationSummary logs a single line with stats aggregated across all clusters of the iteration
+func logIterationSummary(results []clusterResult, nextRun time.Time) {
+	processed, skipped, failed, metrics := 0, 0, 0, 0
+	nodes := int64(0)
+	insertDuration := time.Duration(0)
+	for _, r := range results {
+		if r.failed {
+			failed++
+			continue
+		}
+		if r.skipped {
+			skipped++
+			continue
+		}
+		processed++
+		metrics += r.metrics
+		nodes += r.nodes
+		insertDuration += r.insertDuration
+	}
 
-		var wg sync.WaitGroup
-		clusters := int32(0)
-		for idx := range config.Clusters {
-			clusterLimiter.enter()
-			cluster := &config.Clusters[idx]
-			wg.Add(1)
-			logger.Info("Fetching results",
-				zap.Any("cluster", cluster),
+	logger.Info("iteration summary",
+		zap.Int("clusters_processed", processed),
+		zap.Int("clusters_skipped", skipped),
+		zap.Int("clusters_failed", failed),
+		zap.Int("metrics", metrics),
+		zap.Int64("nodes_stored", nodes),
+		zap.Duration("insert_duration", insertDuration),
+		zap.Time("next_run", nextRun),
+	)
+}
+
+// parseTreeWithRetries retries failed parseTree up to ClusterRetries times, doubling ClusterRetryBackoff between
+// attempts. It gives up if the next attempt would start after deadline, so the iteration doesn't overrun.
+// Fetches that are still running at deadline are aborted.
+func parseTreeWithRetries(ctx context.Context, cluster *types.Cluster, t int64, deadline time.Time) (res clusterResult) {
+	defer func(parent context.Context) {
+		// Clusters aborted by shutdown are not failures worth a notification
+		if res.failed && parent.Err() == nil {
+			go notifyFailure(cluster.Name, res)
+		}
+	}(ctx)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	backoff := config.ClusterRetryBackoff
+	res = parseTree(ctx, cluster, t)
+	for attempt := 1; attempt <= config.ClusterRetries && res.failed; attempt++ {
+		if res.partial {
+			logger.Error("part of the snapshot was stored, it won't be retried",
+				zap.String("cluster", cluster.Name),
+				zap.Int64("nodes_stored", res.nodes),
+			)
+			break
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			logger.Error("no time left in the iteration to retry",
+				zap.String("cluster", cluster.Name),
+				zap.Time("deadline", deadline),
 			)
+			break
+		}
+		logger.Warn("processing cluster failed, will retry",
+			zap.String("cluster", cluster.Name),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+		)
+		clusterRetries.Add(cluster.Name, 1)
+		if !sleepContext(ctx, backoff) {
+			break
+		}
+		backoff *= 2
+		res = parseTree(ctx, cluster, t)
+	}
+	return res
+}
 
-			go func(t int64) {
-				parseTree(cluster, t)
-				clusterLimiter.leave()
-				wg.Done()
-				atomic.AddInt32(&clusters, -1)
+// processClusters runs parseTree for every cluster. ClustersInParallel workers take clusters from a queue, so
+// a slow cluster only occupies its own worker and the rest keep being dispatched. Once ctx is canceled, clusters
+// that are being processed are finished and the rest are marked as failed.
+func processClusters(ctx context.Context, clusters []*types.Cluster, t int64) []clusterResult {
+	deadline := time.Unix(t, 0).Add(config.RerunInterval)
+	results := make([]clusterResult, len(clusters))
+	queue := make(chan int, len(clusters))
+	for idx := range clusters {
+		queue <- idx
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for w := 0; w < config.ClustersInParallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				if ctx.Err() != nil {
+					results[idx].failed = true
+					continue
+				}
+				cluster := clusters[idx]
+				logger.Info("Fetching results",
+					zap.Any("cluster", cluster),
+				)
+				results[idx] = parseTreeWithRetries(ctx, cluster, t, deadline)
 				if config.MemoryProfile != "" {
-					f, err := os.Create(config.MemoryProfile + "." + cluster.Name)
-					if err != nil {
-						logger.Error("cannot create memory profile",
-							zap.Error(err),
-						)
-						return
-					}
-					pprof.WriteHeapProfile(f)
-					f.Close()
+					writeMemoryProfile(config.MemoryProfile + "." + cluster.Name)
 				}
-			}(t0.Unix())
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func writeMemoryProfile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		logger.Error("cannot create memory profile",
+			zap.Error(err),
+		)
+		return
+	}
+	pprof.WriteHeapProfile(f)
+	f.Close()
+}
+
+// processData runs iterations until ctx is canceled. It returns once the current iteration and all scheduled
+// clusters have stopped.
+func processData(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Clusters with their own Interval are processed by runScheduledCluster
+	clusters := make([]*types.Cluster, 0, len(config.Clusters))
+	for i := range config.Clusters {
+		if config.Clusters[i].Interval == 0 {
+			clusters = append(clusters, &config.Clusters[i])
+			continue
 		}
-		wg.Wait()
+		wg.Add(1)
+		go func(cluster *types.Cluster) {
+			defer wg.Done()
+			runScheduledCluster(ctx, cluster)
+		}(&config.Clusters[i])
+	}
+
+	all := clusters
+	offset := 0
+	for {
+		t0 := time.Now()
+		logger.Info("Iteration start")
+		if config.ClustersPerIteration > 0 {
+			var window []*types.Cluster
+			window, offset = clusterWindow(all, config.ClustersPerIteration, offset)
+			names := make([]string, 0, len(window))
+			for _, c := range window {
+				names = append(names, c.Name)
+			}
+			logger.Info("processing window of clusters",
+				zap.Int("clusters_per_iteration", config.ClustersPerIteration),
+				zap.Int("total_clusters", len(all)),
+				zap.Strings("clusters", names),
+			)
+			clusters = window
+		}
+		lastRuns.started(clusters, t0)
+
+		results := processClusters(ctx, clusters, t0.Unix())
 
 		if !config.DryRun {
-			err := updateTimestamps(config.Clusters, t0.Unix())
+			written := make([]types.Cluster, 0, len(clusters))
+			for i := range clusters {
+				if !results[i].skipped && !results[i].failed {
+					written = append(written, *clusters[i])
+				}
+			}
+			err := updateTimestamps(written, t0.Unix())
 			if err != nil {
 				logger.Error("failed to update timestamps",
 					zap.Error(err),
 				)
+			} else if len(written) > 0 {
+				markIterationSuccess(time.Now())
+				publishSnapshots(clusters, results, t0.Unix())
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err := skew.check(); err != nil {
+				logger.Error("rollups and deltas won't be written",
+					zap.Error(err),
+				)
+			} else {
+				runRollups(time.Now())
+				if config.DeltaSnapshots {
+					runDeltas(t0.Unix())
+				}
 			}
 		}
 
-		spentTime := time.Since(t0)
-		sleepTime := config.RerunInterval - spentTime
+		if config.DryRun {
+			markIterationSuccess(time.Now())
+		}
+
+		t1 := time.Now()
+		lastRuns.finished(clusters, results, t1)
+		spentTime := t1.Sub(t0)
+		sleepTime := nextRun(t0, t1, config.RerunInterval).Sub(t1)
 		logger.Info("All work is done!",
 			zap.Duration("total_processing_time_seconds", spentTime),
 			zap.Duration("sleep_time", sleepTime),
 		)
-		time.Sleep(sleepTime)
+		if config.LogIterationSummary {
+			logIterationSummary(results, time.Now().Add(sleepTime))
+		}
+		if !sleepContext(ctx, sleepTime) {
+			return
+		}
 	}
 }
 
@@ -561,6 +1179,9 @@ func (ec expireCache) set(k string, v []byte, expire int32) {
 	ec.ec.Set(k, v, uint64(len(v)), expire)
 }
 
+// envPrefix is the prefix of environment variables that override the config file, e.x. CARBONSERVER_COLLECTOR_LISTEN
+const envPrefix = "CARBONSERVER_COLLECTOR_"
+
 var config = struct {
 	ClustersInParallel  int
 	FetchPerCluster     int
@@ -569,17 +1190,102 @@ var config = struct {
 	Clusters            []types.Cluster
 	DryRun              bool
 	ClickhouseHost      string
-	Listen              string
+	Listen              string // address of status endpoints
+	LogLevel            string // debug, info, warn or error
 	CacheSize           uint64
 	CacheTimeoutSeconds int32
 	RowsPerInsert       int
 
 	MemoryProfile string
 
+	// ClustersPerIteration, if set, processes only that many clusters per iteration, the next iteration takes the
+	// next ones, wrapping around. Clusters with their own Interval are not affected.
+	ClustersPerIteration int
+
+	// MaxChildrenIds limits amount of children ids stored per node, only the largest children are kept
+	MaxChildrenIds int
+
+	// DeltaEncodeChildrenIds stores children_ids as differences between neighbours, which compresses better
+	DeltaEncodeChildrenIds bool
+
 	UseDistributedTables   bool
 	DistributedClusterName string
 
+	// Rollups is a list of periods ("weekly", "monthly") for which max value of every node is stored as a separate graph_type
+	Rollups        []string
+	RollupMaxLevel int
+
+	// DeltaSnapshots enables storing difference with the snapshot taken a day before as a separate graph_type
+	DeltaSnapshots bool
+	DeltaMaxLevel  int
+
+	// LogIterationSummary logs stats aggregated across clusters after every iteration
+	LogIterationSummary bool
+
+	// PathParser selects how metric names are split into path elements: "dot" or "tagged"
+	PathParser string
+
+	// ValidateTree checks every built tree for nodes which children add up to more than the node and logs them
+	ValidateTree bool
+
+	// TotalMode selects what Total of a node means: "global" is the size of the whole disk, "subtree" is
+	// the node's own value
+	TotalMode string
+
+	Breaker breakerConfig
+
+	// IdentityHeader is a header set by authenticating proxy, client's IP is used if it's empty. Only
+	// AdminIdentities can reset circuit breakers.
+	IdentityHeader  string
+	AdminIdentities []string
+
+	// FailureWebhook receives a POST with a clusterFailure every time a cluster fails after all retries
+	FailureWebhook string
+
+	HostHealth hostHealthConfig
+
+	// MemoryLimitMB aborts building a cluster's tree if heap grows over it, instead of getting OOM-killed
+	MemoryLimitMB uint64
+
+	// FetchRetries is how many times a failed request to a host is retried. Wait between attempts starts at
+	// FetchRetryBackoff and doubles up to FetchRetryMaxBackoff, FetchRetryJitter is its random fraction
+	FetchRetries         int
+	FetchRetryBackoff    time.Duration
+	FetchRetryMaxBackoff time.Duration
+	FetchRetryJitter     float64
+
+	// ShutdownTimeout is how long clusters that are being processed can take after SIGTERM or SIGINT
+	ShutdownTimeout time.Duration
+
+	// ClusterRetries is how many times a failed cluster is retried within the iteration
+	ClusterRetries      int
+	ClusterRetryBackoff time.Duration
+
+	// Connection pool to ClickHouse is shared by all clusters, a single insert holds one connection at a time
+	ClickhouseMaxOpenConns    int
+	ClickhouseMaxIdleConns    int
+	ClickhouseConnMaxLifetime time.Duration
+
+	// Unreachable ClickHouse is retried with backoff from ClickhouseRetryInitial up to ClickhouseRetryMax,
+	// once it's up it's pinged every ClickhousePingInterval so /readyz notices outages between iterations
+	ClickhouseRetryInitial time.Duration
+	ClickhouseRetryMax     time.Duration
+	ClickhousePingInterval time.Duration
+
+	// Clock of the collector is compared with ClickHouse's at startup and every ClockSkewCheckInterval. Skew over
+	// ClockSkewWarn is logged as a warning, over ClockSkewMax snapshots are not written. 0 disables the limit.
+	ClockSkewWarn          time.Duration
+	ClockSkewMax           time.Duration
+	ClockSkewCheckInterval time.Duration
+
+	// /events keeps EventsBufferSize last snapshots for clients that reconnect, serves at most EventsMaxClients
+	// and sends a heartbeat every EventsHeartbeat
+	EventsBufferSize int
+	EventsMaxClients int
+	EventsHeartbeat  time.Duration
+
 	queryCache expireCache
+	parser     pathParser
 	db         *sql.DB
 }{
 	ClustersInParallel:  2,
@@ -587,14 +1293,56 @@ var config = struct {
 	RerunInterval:       10 * time.Minute,
 	DryRun:              false,
 	ClickhouseHost:      "tcp://127.0.0.1:9000?debug=false",
-	Listen:              "[::]:8088",
+	Listen:              "0.0.0.0:18000",
 	CacheSize:           0,
 	CacheTimeoutSeconds: 60,
 	MemoryProfile:       "",
 	RowsPerInsert:       100000,
 
+	FetchRetries:         2,
+	FetchRetryBackoff:    time.Second,
+	FetchRetryMaxBackoff: 30 * time.Second,
+	FetchRetryJitter:     0.2,
+
+	ShutdownTimeout: time.Minute,
+
+	ClusterRetries:      2,
+	ClusterRetryBackoff: 30 * time.Second,
+
+	ClickhouseMaxOpenConns:    8,
+	ClickhouseMaxIdleConns:    4,
+	ClickhouseConnMaxLifetime: time.Hour,
+
+	ClickhouseRetryInitial: time.Second,
+	ClickhouseRetryMax:     time.Minute,
+	ClickhousePingInterval: 30 * time.Second,
+
+	ClockSkewWarn:          5 * time.Second,
+	ClockSkewMax:           time.Minute,
+	ClockSkewCheckInterval: 10 * time.Minute,
+
+	EventsBufferSize: 1000,
+	EventsMaxClients: 100,
+	EventsHeartbeat:  15 * time.Second,
+
 	UseDistributedTables:   true,
 	DistributedClusterName: "flamegraph",
+
+	RollupMaxLevel: 6,
+	DeltaMaxLevel:  6,
+
+	LogIterationSummary: true,
+	PathParser:          "dot",
+	TotalMode:           totalModeGlobal,
+
+	Breaker: breakerConfig{
+		MaxChange:  0.5,
+		CloseAfter: 3,
+	},
+
+	HostHealth: hostHealthConfig{
+		SkipFor: 10 * time.Minute,
+	},
 }
 
 func getClusters() ([]string, error) {
@@ -666,8 +1414,11 @@ func createFlameGraphTable(tablePostfix, engine string) error {
 			name String,
 			total Int64,
 			value Int64,
+			value_negative Int64 DEFAULT 0,
 			parent_id Int64,
 			children_ids Array(Int64),
+			children_ids_encoding UInt8 DEFAULT 0,
+			children_truncated UInt8 DEFAULT 0,
 			level Int64,
 			date Date,
 			mtime Int64,
@@ -688,6 +1439,20 @@ func createFlameGraphClusterTable(tablePostfix, engine string) error {
 	return err
 }
 
+func createMetadataTable(tablePostfix, engine string) error {
+	_, err := config.db.Exec("CREATE TABLE IF NOT EXISTS flamegraph_metadata" + tablePostfix + ` (
+			graph_type String,
+			cluster String,
+			timestamp Int64,
+			key String,
+			value String,
+			date Date,
+			version UInt64 DEFAULT 0
+		) engine=` + engine)
+
+	return err
+}
+
 func createLocalTables(tablePostfix string) error {
 	_, err := config.db.Exec(`
 		CREATE TABLE IF NOT EXISTS new_flamegraph_table_version_local (
@@ -716,6 +1481,11 @@ func createLocalTables(tablePostfix string) error {
 		return err
 	}
 
+	err = createMetadataTable(tablePostfix, "ReplacingMergeTree(date, (graph_type, cluster, timestamp, key), 8192, version)")
+	if err != nil {
+		return err
+	}
+
 	err = createFlameGraphClusterTable(tablePostfix, "MergeTree(date, (graph_type, cluster, date), 8192)")
 	return err
 }
@@ -736,10 +1506,33 @@ func createDistributedTables() error {
 		return err
 	}
 
+	err = createMetadataTable("", "Distributed(flamegraph, 'default', 'flamegraph_metadata_local', sipHash64(cluster))")
+	if err != nil {
+		return err
+	}
+
 	err = createFlameGraphClusterTable("", "Distributed(flamegraph, 'default', 'new_flamegraph_clusters_local', sipHash64(cluster))")
 	return err
 }
 
+// addColumnIfNotExists adds column to the table and, if distributed tables are used, to the local table
+func addColumnIfNotExists(table, column string) {
+	tables := []string{table}
+	if config.UseDistributedTables {
+		tables = append(tables, table+"_local")
+	}
+	for _, t := range tables {
+		_, err := config.db.Exec("ALTER TABLE " + t + " ADD COLUMN IF NOT EXISTS " + column)
+		if err != nil {
+			logger.Warn("failed to add column",
+				zap.String("table", t),
+				zap.String("column", column),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
 func migrateOrCreateTables() {
 	tablePostfix := ""
 	if config.UseDistributedTables {
@@ -763,6 +1556,11 @@ func migrateOrCreateTables() {
 		}
 	}
 
+	// Columns that were added after the tables were created
+	addColumnIfNotExists("flamegraph", "children_truncated UInt8 DEFAULT 0 AFTER children_ids")
+	addColumnIfNotExists("flamegraph", "children_ids_encoding UInt8 DEFAULT 0 AFTER children_ids")
+	addColumnIfNotExists("flamegraph", "value_negative Int64 DEFAULT 0 AFTER value")
+
 	// Check version of the table schema if any version is present
 
 	rows, err := config.db.Query("SELECT max(schema_version) FROM new_flamegraph_table_version_local")
@@ -844,11 +1642,100 @@ func main() {
 			zap.Error(err),
 		)
 	}
+	// Variables take precedence over the config file
+	helper.OverrideFromEnv(envPrefix, map[string]*string{
+		"LISTEN":          &config.Listen,
+		"CLICKHOUSE_HOST": &config.ClickhouseHost,
+		"LOG_LEVEL":       &config.LogLevel,
+	})
+
+	logger, err = helper.NewLogger(config.LogLevel)
+	if err != nil {
+		fmt.Printf("Error creating logger: %+v\n", err)
+		os.Exit(1)
+	}
 
 	if len(config.Clusters) == 0 {
 		logger.Fatal("No clusters configured")
 	}
 
+	if config.ClustersInParallel <= 0 {
+		logger.Fatal("ClustersInParallel must be positive",
+			zap.Int("clusters_in_parallel", config.ClustersInParallel),
+		)
+	}
+
+	if config.EventsBufferSize <= 0 || config.EventsMaxClients <= 0 || config.EventsHeartbeat <= 0 {
+		logger.Fatal("EventsBufferSize, EventsMaxClients and EventsHeartbeat must be positive",
+			zap.Int("events_buffer_size", config.EventsBufferSize),
+			zap.Int("events_max_clients", config.EventsMaxClients),
+			zap.Duration("events_heartbeat", config.EventsHeartbeat),
+		)
+	}
+
+	if config.HostHealth.UnhealthyAfter > 0 && config.HostHealth.SkipFor <= 0 {
+		logger.Fatal("HostHealth.SkipFor must be positive when HostHealth.UnhealthyAfter is set",
+			zap.Duration("skip_for", config.HostHealth.SkipFor),
+		)
+	}
+
+	if config.ClustersPerIteration < 0 {
+		logger.Fatal("ClustersPerIteration can't be negative",
+			zap.Int("clusters_per_iteration", config.ClustersPerIteration),
+		)
+	}
+
+	for _, period := range config.Rollups {
+		if period != rollupWeekly && period != rollupMonthly {
+			logger.Fatal("unknown rollup period",
+				zap.String("period", period),
+			)
+		}
+	}
+
+	if err := resolveVirtualClusters(config.Clusters); err != nil {
+		logger.Fatal("invalid cluster configuration",
+			zap.Error(err),
+		)
+	}
+
+	for i := range config.Clusters {
+		if err := config.Clusters[i].Validate(); err != nil {
+			logger.Fatal("invalid cluster configuration",
+				zap.Error(err),
+			)
+		}
+		if config.Clusters[i].Flavor == "" {
+			config.Clusters[i].Flavor = "go-carbon"
+		}
+		if err := validateFlavor(config.Clusters[i].Flavor); err != nil {
+			logger.Fatal("invalid cluster configuration",
+				zap.String("cluster", config.Clusters[i].Name),
+				zap.Error(err),
+			)
+		}
+	}
+
+	httpClients, err = newHTTPClients(config.Clusters)
+	if err != nil {
+		logger.Fatal("invalid cluster configuration",
+			zap.Error(err),
+		)
+	}
+
+	config.parser, err = getPathParser(config.PathParser)
+	if err != nil {
+		logger.Fatal("invalid path parser",
+			zap.Error(err),
+		)
+	}
+
+	if config.TotalMode != totalModeGlobal && config.TotalMode != totalModeSubtree {
+		logger.Fatal("TotalMode must be either 'global' or 'subtree'",
+			zap.String("total_mode", config.TotalMode),
+		)
+	}
+
 	config.queryCache = expireCache{ec: ecache.New(config.CacheSize)}
 	go config.queryCache.ec.ApproximateCleaner(10 * time.Second)
 
@@ -857,24 +1744,61 @@ func main() {
 		zap.Any("config", config),
 	)
 
+	// Malformed DSN won't fix itself, but unreachable ClickHouse might be a maintenance window
+	err = helper.ValidateClickhouseDSN(config.ClickhouseHost)
+	if err != nil {
+		logger.Fatal("invalid ClickhouseHost",
+			zap.Error(err),
+		)
+	}
+
 	config.db, err = sql.Open("clickhouse", config.ClickhouseHost)
 	if err != nil {
 		logger.Fatal("error connecting to clickhouse",
 			zap.Error(err),
 		)
 	}
+	config.db.SetMaxOpenConns(config.ClickhouseMaxOpenConns)
+	config.db.SetMaxIdleConns(config.ClickhouseMaxIdleConns)
+	config.db.SetConnMaxLifetime(config.ClickhouseConnMaxLifetime)
+
+	http.HandleFunc("/breaker", breakerHandler)
+	http.HandleFunc("/hosts", hostHealthHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/health", healthzHandler)
+	http.HandleFunc("/ready", readyHandler)
+	http.HandleFunc("/schedule", scheduleHandler)
+	http.HandleFunc("/events", eventsHandler)
+
+	go func() {
+		err := http.ListenAndServe(config.Listen, recoverPanic(http.DefaultServeMux))
+		logger.Error("error serving status endpoints",
+			zap.Error(err),
+		)
+	}()
 
-	if err = config.db.Ping(); err != nil {
-		if exception, ok := err.(*clickhouse.Exception); ok {
-			logger.Fatal("exception while pinging clickhouse",
-				zap.Int32("code", exception.Code),
-				zap.String("message", exception.Message),
-				zap.Any("stacktrace", exception.StackTrace),
-			)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !waitForClickhouse(ctx, config.ClickhouseRetryInitial, config.ClickhouseRetryMax) {
+			return
 		}
-		logger.Fatal("error pinging clickhouse", zap.Error(err))
-	}
+		go keepClickhouseAlive(config.ClickhousePingInterval)
+		skew.update(ctx)
+		go keepMeasuringClockSkew(ctx, config.ClockSkewCheckInterval)
+		prepareClickhouse()
+		processData(ctx)
+	}()
 
+	waitForShutdown(cancel, done, config.ShutdownTimeout)
+	logger.Sync()
+}
+
+// prepareClickhouse creates or migrates tables and loads state kept in ClickHouse
+func prepareClickhouse() {
 	migrateOrCreateTables()
 
 	knownClusters, err := getClusters()
@@ -882,7 +1806,6 @@ func main() {
 		logger.Fatal("Error retreiving clusters",
 			zap.Error(err),
 		)
-		return
 	}
 
 	unknownClusters := make(map[string]bool, 0)
@@ -913,7 +1836,12 @@ func main() {
 		}
 	}
 
-	go processData()
-
-	http.ListenAndServe("0.0.0.0:18000", nil)
+	if config.Breaker.OpenAfter > 0 && !config.DryRun {
+		err = breaker.load()
+		if err != nil {
+			logger.Error("failed to load circuit breaker state",
+				zap.Error(err),
+			)
+		}
+	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+)
+
+func TestDetailsMerger(t *testing.T) {
+	host := func(free, total uint64, metrics map[string]*pb.MetricDetails) *pb.MetricDetailsResponse {
+		return &pb.MetricDetailsResponse{FreeSpace: free, TotalSpace: total, Metrics: metrics}
+	}
+	details := func(size, mtime int64) *pb.MetricDetails {
+		return &pb.MetricDetails{Size_: size, ModTime: mtime}
+	}
+
+	tests := []struct {
+		name     string
+		hosts    []*pb.MetricDetailsResponse
+		expected *pb.MetricDetailsResponse
+		replicas map[string]int64
+	}{
+		{
+			name:     "no hosts",
+			expected: host(0, 0, map[string]*pb.MetricDetails{}),
+			replicas: map[string]int64{},
+		},
+		{
+			name: "single host",
+			hosts: []*pb.MetricDetailsResponse{
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+			},
+			expected: host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+			replicas: map[string]int64{},
+		},
+		{
+			// Same disks are seen through every replica, so space is divided by the replication factor
+			name: "two replicas",
+			hosts: []*pb.MetricDetailsResponse{
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+				host(110, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+			},
+			expected: host(105, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+			replicas: map[string]int64{"a": 1, "b": 1},
+		},
+		{
+			name: "three replicas",
+			hosts: []*pb.MetricDetailsResponse{
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10)}),
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10)}),
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10)}),
+			},
+			expected: host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10)}),
+			replicas: map[string]int64{"a": 2},
+		},
+		{
+			// Metric that is on every host sets the factor, even if other metrics are on fewer hosts
+			name: "uneven replication",
+			hosts: []*pb.MetricDetailsResponse{
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "c": details(3, 30)}),
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10)}),
+			},
+			expected: host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20), "c": details(3, 30)}),
+			replicas: map[string]int64{"a": 2},
+		},
+		{
+			name: "disjoint hosts",
+			hosts: []*pb.MetricDetailsResponse{
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 10)}),
+				host(50, 200, map[string]*pb.MetricDetails{"b": details(2, 20)}),
+			},
+			expected: host(150, 500, map[string]*pb.MetricDetails{"a": details(1, 10), "b": details(2, 20)}),
+			replicas: map[string]int64{},
+		},
+		{
+			// Replicas that diverged are merged into the largest and most recently modified one
+			name: "diverged replicas",
+			hosts: []*pb.MetricDetailsResponse{
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(5, 10)}),
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(1, 30)}),
+				host(100, 300, map[string]*pb.MetricDetails{"a": details(3, 20)}),
+			},
+			expected: host(100, 300, map[string]*pb.MetricDetails{"a": details(5, 30)}),
+			replicas: map[string]int64{"a": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newDetailsMerger()
+			for _, h := range tt.hosts {
+				m.add(h)
+			}
+			got, replicas, succeeded := m.result()
+			if succeeded != len(tt.hosts) {
+				t.Errorf("expected %v merged hosts, got %v", len(tt.hosts), succeeded)
+			}
+			if got.FreeSpace != tt.expected.FreeSpace || got.TotalSpace != tt.expected.TotalSpace {
+				t.Errorf("expected free/total space %v/%v, got %v/%v", tt.expected.FreeSpace, tt.expected.TotalSpace, got.FreeSpace, got.TotalSpace)
+			}
+			if !reflect.DeepEqual(got.Metrics, tt.expected.Metrics) {
+				t.Errorf("expected metrics %v, got %v", tt.expected.Metrics, got.Metrics)
+			}
+			if !reflect.DeepEqual(replicas, tt.replicas) {
+				t.Errorf("expected replication counters %v, got %v", tt.replicas, replicas)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// pathParser splits metric name into the path elements of the tree
+type pathParser interface {
+	ParsePath(metric string) []string
+}
+
+type dotParser struct{}
+
+func (dotParser) ParsePath(metric string) []string {
+	return strings.Split(metric, ".")
+}
+
+// taggedParser handles graphite tagged metrics (name;tag1=value1;tag2=value2). Name is split by dots and
+// tags follow it sorted by tag name, so the same series always ends up at the same path.
+type taggedParser struct{}
+
+func (taggedParser) ParsePath(metric string) []string {
+	parts := strings.Split(metric, ";")
+	path := strings.Split(parts[0], ".")
+	tags := parts[1:]
+	sort.Strings(tags)
+	return append(path, tags...)
+}
+
+var pathParsers = map[string]pathParser{
+	"dot":    dotParser{},
+	"tagged": taggedParser{},
+}
+
+func getPathParser(name string) (pathParser, error) {
+	p, ok := pathParsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown path parser %v", name)
+	}
+	return p, nil
+}
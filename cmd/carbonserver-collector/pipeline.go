@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// fetchedMetrics is what was fetched for a cluster during one iteration. It's produced once by parseTree and
+// handed to every consumer, so a new artifact doesn't mean another fetch or a copy of the list. Consumers must
+// treat it as read-only, it's released once the last of them is done.
+type fetchedMetrics struct {
+	cluster  *types.Cluster
+	t        int64
+	details  *pb.MetricDetailsResponse
+	replicas map[string]int64
+	metadata map[string]string
+}
+
+// approxDetailsBytes estimates memory held by fetched metrics: names plus a fixed overhead per map entry and details
+func approxDetailsBytes(details *pb.MetricDetailsResponse) int64 {
+	res := int64(0)
+	for name := range details.Metrics {
+		res += int64(len(name)) + 96
+	}
+	return res
+}
+
+func (f *fetchedMetrics) release() {
+	f.details, f.replicas = nil, nil
+}
+
+// metricsConsumer builds something out of fetched metrics. To store another artifact of the same fetch (a new
+// graph type, per-host trees, etc), implement it and add it to metricsConsumers. A consumer that committed rows
+// must set res.partial, so a failure of a later consumer doesn't make parseTreeWithRetries store them again.
+type metricsConsumer interface {
+	Name() string
+	// Enabled reports whether the consumer wants metrics of the cluster
+	Enabled(cluster *types.Cluster) bool
+	Consume(f *fetchedMetrics, res *clusterResult) error
+}
+
+// Metric stats go after the tree: their failure isn't a failure of the cluster, so a tree that failed to be stored
+// can be retried without writing the stats twice
+var metricsConsumers = []metricsConsumer{
+	flamegraphConsumer{},
+	metricStatsConsumer{},
+}
+
+// runConsumers hands metrics to consumers in order and releases them afterwards. It stops at the first error or
+// if heap is already over MemoryLimitMB, as consumers that come later would only grow it.
+func runConsumers(f *fetchedMetrics, res *clusterResult) error {
+	defer f.release()
+	for _, c := range metricsConsumers {
+		if !c.Enabled(f.cluster) {
+			continue
+		}
+		if err := helper.CheckMemoryLimit(config.MemoryLimitMB); err != nil {
+			return fmt.Errorf("%v: %v", c.Name(), err)
+		}
+		t0 := time.Now()
+		err := c.Consume(f, res)
+		logger.Debug("consumer finished",
+			zap.String("cluster", f.cluster.Name),
+			zap.String("consumer", c.Name()),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Error(err),
+		)
+		if err != nil {
+			return fmt.Errorf("%v: %v", c.Name(), err)
+		}
+	}
+	return nil
+}
+
+// metricStatsConsumer stores per-metric details (mtime, atime, rdtime) of carbonserver clusters
+type metricStatsConsumer struct{}
+
+func (metricStatsConsumer) Name() string {
+	return "metric_stats"
+}
+
+func (metricStatsConsumer) Enabled(cluster *types.Cluster) bool {
+	return !config.DryRun && cluster.Source != types.SourcePrometheus
+}
+
+func (metricStatsConsumer) Consume(f *fetchedMetrics, res *clusterResult) error {
+	if sendMetricsStatsToClickhouse(f.details, f.t, f.cluster.Name) > 0 {
+		res.partial = true
+	}
+	return nil
+}
+
+// flamegraphConsumer builds the tree and stores it with the snapshot metadata
+type flamegraphConsumer struct{}
+
+func (flamegraphConsumer) Name() string {
+	return "flamegraph"
+}
+
+func (flamegraphConsumer) Enabled(cluster *types.Cluster) bool {
+	return true
+}
+
+func (flamegraphConsumer) Consume(f *fetchedMetrics, res *clusterResult) error {
+	cluster, details := f.cluster, f.details
+
+	var structure string
+	if cluster.StoreOnStructureChange && !config.DryRun {
+		structure = structureHash(details)
+		if structure == lastStructures.get(cluster.Name) {
+			logger.Info("structure didn't change, snapshot is not stored",
+				zap.String("cluster", cluster.Name),
+			)
+			res.skipped = true
+			return nil
+		}
+		f.metadata[structureHashKey] = structure
+	}
+
+	flameGraphTreeRoot := &types.FlameGraphNode{
+		Id:      types.RootElementId,
+		Cluster: cluster.Name,
+		Name:    "[disk]",
+		Value:   0,
+		Total:   int64(details.TotalSpace),
+		Parent:  nil,
+	}
+
+	freeSpaceNode := &types.FlameGraphNode{
+		Id:      types.RootElementId + 1,
+		Cluster: cluster.Name,
+		Name:    "[free]",
+		Value:   int64(details.FreeSpace),
+		Total:   int64(details.TotalSpace),
+		Parent:  flameGraphTreeRoot,
+	}
+
+	flameGraphTreeRoot.ChildrenIds = append(flameGraphTreeRoot.ChildrenIds, types.RootElementId+1)
+	flameGraphTreeRoot.Children = append(flameGraphTreeRoot.Children, freeSpaceNode)
+
+	err := constructTree(flameGraphTreeRoot, details)
+	if err != nil {
+		return fmt.Errorf("failed to construct tree: %v", err)
+	}
+
+	flameGraphTreeRoot.Value = int64(details.TotalSpace)
+	if config.ValidateTree {
+		validateTree(flameGraphTreeRoot)
+	}
+	applyTotalMode(flameGraphTreeRoot)
+
+	warnIfEverythingTrimmed(flameGraphTreeRoot)
+
+	if config.DryRun {
+		data, err := json.Marshal(flameGraphTreeRoot)
+		if err != nil {
+			logger.Error("failed to marshal data to json",
+				zap.Error(err),
+			)
+		} else {
+			fmt.Printf("%v\b", string(data))
+		}
+		return nil
+	}
+
+	checksum, err := treeChecksum(flameGraphTreeRoot)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksum: %v", err)
+	}
+	f.metadata[helper.ChecksumVersionKey] = helper.CurrentChecksumVersion
+	f.metadata[helper.ChecksumKey] = checksum
+
+	// Convert to clickhouse format
+	t1 := time.Now()
+	res.nodes, err = sendToClickhouse(flameGraphTreeRoot, cluster.GraphType(), f.t)
+	res.insertDuration = time.Since(t1)
+	if res.nodes > 0 {
+		res.partial = true
+	}
+	if err != nil {
+		// Snapshot wasn't stored, there is no spool to keep it until ClickHouse is back
+		return fmt.Errorf("failed to store tree: %v", err)
+	}
+	if structure != "" {
+		lastStructures.set(cluster.Name, structure)
+	}
+	err = sendSnapshotMetadata(cluster.GraphType(), cluster.Name, f.t, f.metadata)
+	if err != nil {
+		logger.Error("failed to send snapshot metadata",
+			zap.String("cluster", cluster.Name),
+			zap.Error(err),
+		)
+	}
+	return nil
+}
+
+// treeChecksum computes checksum of the nodes the way they are going to be stored
+func treeChecksum(root *types.FlameGraphNode) (string, error) {
+	var nodes []helper.ChecksumNode
+	var walk func(n *types.FlameGraphNode)
+	walk = func(n *types.FlameGraphNode) {
+		parentID := int64(0)
+		if n.Parent != nil {
+			parentID = n.Parent.Id
+		}
+		nodes = append(nodes, helper.ChecksumNode{
+			Id:       n.Id,
+			ParentID: parentID,
+			Name:     n.Name,
+			Value:    n.Value,
+		})
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return helper.SnapshotChecksum(helper.CurrentChecksumVersion, nodes)
+}
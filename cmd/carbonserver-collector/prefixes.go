@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// normalizePrefix turns "servers.dc3.*" and "servers.dc3." into "servers.dc3"
+func normalizePrefix(p string) string {
+	return strings.TrimRight(strings.TrimSuffix(p, "*"), ".")
+}
+
+func hasPrefix(metric string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if metric == p || strings.HasPrefix(metric, p) && metric[len(p)] == '.' {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPrefixes drops metrics that are not under any of the prefixes. Neither go-carbon nor classic carbonserver
+// can restrict /metrics/details by prefix, so it's done after the fetch.
+func filterPrefixes(details *pb.MetricDetailsResponse, prefixes []string) int {
+	normalized := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		normalized = append(normalized, normalizePrefix(p))
+	}
+
+	removed := 0
+	for metric := range details.Metrics {
+		if !hasPrefix(metric, normalized) {
+			delete(details.Metrics, metric)
+			removed++
+		}
+	}
+	return removed
+}
+
+// resolveVirtualClusters copies hosts, source and connection settings from parents to virtual clusters
+func resolveVirtualClusters(clusters []types.Cluster) error {
+	byName := make(map[string]*types.Cluster, len(clusters))
+	for i := range clusters {
+		byName[clusters[i].Name] = &clusters[i]
+	}
+
+	for i := range clusters {
+		c := &clusters[i]
+		if c.Parent == "" {
+			continue
+		}
+		parent, ok := byName[c.Parent]
+		if !ok {
+			return fmt.Errorf("cluster %v: unknown parent %v", c.Name, c.Parent)
+		}
+		if parent.Parent != "" {
+			return fmt.Errorf("cluster %v: parent %v is a virtual cluster itself", c.Name, c.Parent)
+		}
+		if len(c.QueryPrefixes) == 0 {
+			return fmt.Errorf("cluster %v: virtual cluster must have QueryPrefixes", c.Name)
+		}
+		c.Hosts = parent.Hosts
+		c.Flavor = parent.Flavor
+		c.Source = parent.Source
+		c.Prometheus = parent.Prometheus
+		c.Filesystem = parent.Filesystem
+		c.DisableCompression = parent.DisableCompression
+		c.Port = parent.Port
+		c.PathPrefix = parent.PathPrefix
+		c.ListPath = parent.ListPath
+		c.TLS = parent.TLS
+		if c.FetchTimeout == 0 {
+			c.FetchTimeout = parent.FetchTimeout
+		}
+	}
+	return nil
+}
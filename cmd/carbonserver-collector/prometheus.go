@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const (
+	defaultPrometheusMaxSeries        = 1000000
+	defaultPrometheusMaxResponseBytes = 512 * 1024 * 1024
+	defaultPrometheusRequestInterval  = 10 * time.Second
+)
+
+type prometheusResponse struct {
+	Status string          `json:"status"`
+	Error  string          `json:"error"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// prometheusLastRequest is when the last request to every Prometheus server was made, used for rate limiting
+var prometheusLastRequest = struct {
+	sync.Mutex
+	t map[string]time.Time
+}{
+	t: make(map[string]time.Time),
+}
+
+// waitForPrometheus blocks until at least interval passed since the previous request to the server. It returns
+// false if ctx was canceled first.
+func waitForPrometheus(ctx context.Context, server string, interval time.Duration) bool {
+	prometheusLastRequest.Lock()
+	next := prometheusLastRequest.t[server].Add(interval)
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	prometheusLastRequest.t[server] = next
+	prometheusLastRequest.Unlock()
+
+	return sleepContext(ctx, time.Until(next))
+}
+
+func prometheusGet(ctx context.Context, src *types.PrometheusSource, path string, params url.Values, res interface{}) error {
+	interval := src.RequestInterval
+	if interval == 0 {
+		interval = defaultPrometheusRequestInterval
+	}
+	maxBytes := src.MaxResponseBytes
+	if maxBytes == 0 {
+		maxBytes = defaultPrometheusMaxResponseBytes
+	}
+	if !waitForPrometheus(ctx, src.URL, interval) {
+		return ctx.Err()
+	}
+
+	httpClient := &http.Client{Timeout: 120 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(src.URL, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Read one byte over the limit to tell a response of exactly maxBytes from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBytes {
+		return fmt.Errorf("response of %v is larger than %v bytes", path, maxBytes)
+	}
+
+	var r prometheusResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return err
+	}
+	if r.Status != "success" {
+		return fmt.Errorf("%v failed: %v", path, r.Error)
+	}
+	return json.Unmarshal(r.Data, res)
+}
+
+// seriesPath renders the series as a dotted path. Dots in label values are replaced, so they don't add levels
+func seriesPath(template []string, labels map[string]string) string {
+	parts := make([]string, 0, len(template))
+	for _, l := range template {
+		v := labels[l]
+		if v == "" {
+			v = "[no_" + l + "]"
+		}
+		parts = append(parts, strings.Replace(v, ".", "_", -1))
+	}
+	return strings.Join(parts, ".")
+}
+
+// getPrometheusDetails converts series of a Prometheus-compatible server into metric details. Every series has
+// size of 1, so the tree shows series cardinality.
+func getPrometheusDetails(ctx context.Context, cluster *types.Cluster) (*pb.MetricDetailsResponse, error) {
+	src := &cluster.Prometheus
+	maxSeries := src.MaxSeries
+	if maxSeries == 0 {
+		maxSeries = defaultPrometheusMaxSeries
+	}
+
+	now := time.Now()
+	var paths []string
+	if src.Selector == "" {
+		var names []string
+		err := prometheusGet(ctx, src, "/api/v1/label/__name__/values", url.Values{}, &names)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > maxSeries {
+			return nil, fmt.Errorf("got %v metric names, limit is %v", len(names), maxSeries)
+		}
+		paths = names
+	} else {
+		template := strings.Split(src.PathTemplate, ".")
+		if src.PathTemplate == "" {
+			template = []string{"__name__"}
+		}
+		params := url.Values{
+			"match[]": []string{src.Selector},
+			"start":   []string{strconv.FormatInt(now.Add(-config.RerunInterval).Unix(), 10)},
+			"end":     []string{strconv.FormatInt(now.Unix(), 10)},
+			// Servers that support limit stop early, the rest are still protected by MaxResponseBytes
+			"limit": []string{strconv.Itoa(maxSeries + 1)},
+		}
+		var series []map[string]string
+		err := prometheusGet(ctx, src, "/api/v1/series", params, &series)
+		if err != nil {
+			return nil, err
+		}
+		if len(series) > maxSeries {
+			return nil, fmt.Errorf("selector %v matched more than %v series", src.Selector, maxSeries)
+		}
+		for _, labels := range series {
+			paths = append(paths, seriesPath(template, labels))
+		}
+	}
+
+	response := &pb.MetricDetailsResponse{
+		Metrics: make(map[string]*pb.MetricDetails, len(paths)),
+	}
+	for _, p := range paths {
+		if d, ok := response.Metrics[p]; ok {
+			// Series that differ only in labels that are not in the template
+			d.Size_++
+			continue
+		}
+		response.Metrics[p] = &pb.MetricDetails{Size_: 1, ModTime: now.Unix()}
+	}
+	response.TotalSpace = uint64(len(paths))
+	return response, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+)
+
+const (
+	rollupWeekly  = "weekly"
+	rollupMonthly = "monthly"
+)
+
+// rollupGraphType returns graph_type that is used to store the rollup
+func rollupGraphType(period string) string {
+	return "rollup_max_" + period
+}
+
+// previousPeriod returns boundaries [start, end) of the last complete period before now
+func previousPeriod(period string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case rollupWeekly:
+		// Weeks start on Monday
+		end := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		return end.AddDate(0, 0, -7), end
+	default:
+		end := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return end.AddDate(0, -1, 0), end
+	}
+}
+
+func rollupExists(graphType, cluster string, ts int64) (bool, error) {
+	rows, err := config.db.Query("SELECT count() FROM new_flamegraph_timestamps WHERE graph_type=? AND cluster=? AND timestamp=?", graphType, cluster, ts)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	cnt := uint64(0)
+	for rows.Next() {
+		err = rows.Scan(&cnt)
+		if err != nil {
+			return false, err
+		}
+	}
+	return cnt > 0, rows.Err()
+}
+
+// rollupCluster stores, for every node up to RollupMaxLevel, maximum value across all snapshots in the period.
+// Rollup is stored as a separate graph_type at the last second of the period.
+func rollupCluster(period, cluster string, start, end time.Time) error {
+	graphType := rollupGraphType(period)
+	ts := end.Unix() - 1
+
+	exists, err := rollupExists(graphType, cluster, ts)
+	if err != nil || exists {
+		return err
+	}
+
+	t0 := time.Now()
+	_, err = config.db.Exec(`INSERT INTO flamegraph (timestamp, graph_type, cluster, id, name, total, value, parent_id, children_ids, level, mtime, date, version)
+		SELECT ?, ?, cluster, id, any(name), max(total), max(value), any(parent_id), groupUniqArrayArray(`+helper.ChildrenIdsColumn+`), any(level), max(mtime), toDate(?), ?
+		FROM flamegraph
+		WHERE graph_type='graphite_metrics' AND cluster=? AND date >= toDate(?) AND date < toDate(?) AND timestamp >= ? AND timestamp < ? AND level < ?
+		GROUP BY cluster, id`,
+		ts, graphType, ts, uint64(ts),
+		cluster, start.Unix(), end.Unix(), start.Unix(), end.Unix(), config.RollupMaxLevel,
+	)
+	if err != nil {
+		return err
+	}
+
+	tx, stmt, err := helper.DBStartTransaction(config.db, "INSERT INTO new_flamegraph_timestamps (graph_type, cluster, timestamp, date) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(graphType, cluster, ts, time.Unix(ts, 0))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("rollup stored",
+		zap.String("cluster", cluster),
+		zap.String("graph_type", graphType),
+		zap.Time("period_start", start),
+		zap.Time("period_end", end),
+		zap.Duration("runtime", time.Since(t0)),
+	)
+	return nil
+}
+
+// runRollups stores rollups for the periods that are complete but not yet rolled up
+func runRollups(now time.Time) {
+	for _, period := range config.Rollups {
+		start, end := previousPeriod(period, now)
+		for _, cluster := range config.Clusters {
+			err := rollupCluster(period, cluster.Name, start, end)
+			if err != nil {
+				logger.Error("failed to store rollup",
+					zap.String("cluster", cluster.Name),
+					zap.String("period", period),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
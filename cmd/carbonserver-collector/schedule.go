@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// maxSchedulePreview limits how many future runs /schedule computes per cluster
+const maxSchedulePreview = 100
+
+// nextRun returns when the run that started at start and ended at end is followed by the next one: interval after
+// its start, or right after its end if it took longer than that. Both processData and runScheduledCluster sleep
+// until this time, /schedule uses it for the preview.
+func nextRun(start, end time.Time, interval time.Duration) time.Time {
+	next := start.Add(interval)
+	if next.Before(end) {
+		return end
+	}
+	return next
+}
+
+// clusterWindow returns up to size clusters starting at offset, wrapping around the end, and offset of the next
+// window. Every cluster is processed once in ceil(len(clusters) / size) iterations.
+func clusterWindow(clusters []*types.Cluster, size, offset int) ([]*types.Cluster, int) {
+	if size <= 0 || size >= len(clusters) {
+		return clusters, 0
+	}
+	offset %= len(clusters)
+	window := make([]*types.Cluster, 0, size)
+	for i := 0; i < size; i++ {
+		window = append(window, clusters[(offset+i)%len(clusters)])
+	}
+	return window, (offset + size) % len(clusters)
+}
+
+// windowsPerRotation returns how many iterations it takes to process every cluster without own Interval once
+func windowsPerRotation() int {
+	n := 0
+	for i := range config.Clusters {
+		if config.Clusters[i].Interval == 0 {
+			n++
+		}
+	}
+	if config.ClustersPerIteration <= 0 || n <= config.ClustersPerIteration {
+		return 1
+	}
+	return (n + config.ClustersPerIteration - 1) / config.ClustersPerIteration
+}
+
+type clusterRun struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end,omitempty"`
+	Failed bool      `json:"failed,omitempty"`
+	// Panic and Stack tell what happened if the run failed because of a panic
+	Panic string `json:"panic,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// runHistory keeps the last run of every cluster, so /schedule can show what actually happened
+type runHistory struct {
+	sync.Mutex
+	runs map[string]clusterRun
+}
+
+var lastRuns = &runHistory{runs: make(map[string]clusterRun)}
+
+func (h *runHistory) started(clusters []*types.Cluster, t time.Time) {
+	h.Lock()
+	for _, c := range clusters {
+		h.runs[c.Name] = clusterRun{Start: t}
+	}
+	h.Unlock()
+}
+
+// finished records end of the run, results are in the same order as clusters
+func (h *runHistory) finished(clusters []*types.Cluster, results []clusterResult, t time.Time) {
+	h.Lock()
+	for i, c := range clusters {
+		r := h.runs[c.Name]
+		r.End = t
+		r.Failed = results[i].failed
+		r.Panic = results[i].panic
+		r.Stack = results[i].stack
+		h.runs[c.Name] = r
+	}
+	h.Unlock()
+}
+
+func (h *runHistory) get(cluster string) (clusterRun, bool) {
+	h.Lock()
+	defer h.Unlock()
+	r, ok := h.runs[cluster]
+	return r, ok
+}
+
+type clusterSchedule struct {
+	Cluster  string      `json:"cluster"`
+	Interval string      `json:"interval"`
+	LastRun  *clusterRun `json:"last_run,omitempty"`
+	Running  bool        `json:"running"`
+	NextRuns []time.Time `json:"next_runs"`
+	// Rule explains what determined the first of NextRuns
+	Rule string `json:"rule"`
+	// BreakerOpen means runs happen, but snapshots are not stored
+	BreakerOpen bool `json:"breaker_open"`
+}
+
+// scheduleOf previews n next runs of the cluster as of now
+func scheduleOf(cluster *types.Cluster, n int, now time.Time) clusterSchedule {
+	interval, rule := config.RerunInterval, "global RerunInterval"
+	if cluster.Interval > 0 {
+		interval, rule = cluster.Interval, "own Interval of the cluster"
+	} else if windows := windowsPerRotation(); windows > 1 {
+		interval = time.Duration(windows) * config.RerunInterval
+		rule = "processed every " + strconv.Itoa(windows) + " iterations because of ClustersPerIteration"
+	}
+	res := clusterSchedule{
+		Cluster:  cluster.Name,
+		Interval: interval.String(),
+	}
+
+	breaker.Lock()
+	if s, ok := breaker.clusters[cluster.Name]; ok {
+		res.BreakerOpen = s.Open
+	}
+	breaker.Unlock()
+
+	run, ok := lastRuns.get(cluster.Name)
+	if !ok {
+		res.Rule = "waiting for the first run"
+		return res
+	}
+	res.LastRun = &run
+
+	var next time.Time
+	if run.End.IsZero() {
+		// Duration of the current run is unknown, it's at least as long as it has been running so far
+		res.Running = true
+		next = nextRun(run.Start, now, interval)
+		if !next.After(now) {
+			rule = "running longer than the interval, next run starts right after it"
+		}
+	} else {
+		next = nextRun(run.Start, run.End, interval)
+		if next.Equal(run.End) {
+			rule = "deferred: last run took longer than the interval"
+		}
+	}
+	res.Rule = rule
+	for i := 0; i < n; i++ {
+		res.NextRuns = append(res.NextRuns, next)
+		next = nextRun(next, next, interval)
+	}
+	return res
+}
+
+// scheduleHandler shows when every cluster is going to be processed next, ?n= sets how many runs to preview
+func scheduleHandler(w http.ResponseWriter, req *http.Request) {
+	n := 5
+	if v := req.FormValue("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSchedulePreview {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxSchedulePreview), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	res := make([]clusterSchedule, 0, len(config.Clusters))
+	for i := range config.Clusters {
+		res = append(res, scheduleOf(&config.Clusters[i], n, now))
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// runScheduledCluster processes a cluster with its own Interval, independently of the main iteration
+func runScheduledCluster(ctx context.Context, cluster *types.Cluster) {
+	clusters := []*types.Cluster{cluster}
+	for {
+		t0 := time.Now()
+		lastRuns.started(clusters, t0)
+		res := parseTreeWithRetries(ctx, cluster, t0.Unix(), t0.Add(cluster.Interval))
+		if !config.DryRun && !res.failed && !res.skipped {
+			err := updateTimestamps([]types.Cluster{*cluster}, t0.Unix())
+			if err != nil {
+				logger.Error("failed to update timestamps",
+					zap.String("cluster", cluster.Name),
+					zap.Error(err),
+				)
+			} else {
+				markIterationSuccess(time.Now())
+				publishSnapshots(clusters, []clusterResult{res}, t0.Unix())
+				if ctx.Err() == nil {
+					storeScheduledDelta(cluster, t0.Unix())
+				}
+			}
+		}
+		t1 := time.Now()
+		lastRuns.finished(clusters, []clusterResult{res}, t1)
+		if !sleepContext(ctx, nextRun(t0, t1, cluster.Interval).Sub(t1)) {
+			return
+		}
+	}
+}
+
+// storeScheduledDelta stores the delta of a snapshot taken by runScheduledCluster. processData only computes deltas
+// at its own start time, where clusters with own Interval have no snapshots.
+func storeScheduledDelta(cluster *types.Cluster, t int64) {
+	if !config.DeltaSnapshots {
+		return
+	}
+	if err := skew.check(); err != nil {
+		logger.Error("delta won't be written",
+			zap.String("cluster", cluster.Name),
+			zap.Error(err),
+		)
+		return
+	}
+	err := storeDelta(cluster.Name, t)
+	if err != nil {
+		logger.Error("failed to store delta",
+			zap.String("cluster", cluster.Name),
+			zap.Error(err),
+		)
+	}
+}
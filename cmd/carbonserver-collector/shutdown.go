@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sleepContext sleeps for d and returns false if ctx was canceled before that
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT, then cancels processing and waits up to timeout for clusters
+// that are in progress to finish
+func waitForShutdown(cancel context.CancelFunc, done <-chan struct{}, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	logger.Info("shutting down",
+		zap.String("signal", sig.String()),
+		zap.Duration("timeout", timeout),
+	)
+
+	t0 := time.Now()
+	cancel()
+	select {
+	case <-done:
+		logger.Info("processing stopped",
+			zap.Duration("stop_time", time.Since(t0)),
+		)
+	case <-time.After(timeout):
+		logger.Warn("processing didn't stop in time, exiting anyway",
+			zap.Duration("timeout", timeout),
+		)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// clockSkewKey is the snapshot metadata key of the skew measured before the snapshot was taken
+const clockSkewKey = "clock_skew_ms"
+
+// clockSkewMs is the last measured difference between local clock and ClickHouse's, positive if local is ahead
+var clockSkewMs = expvar.NewInt("clock_skew_ms")
+
+// clockSkew holds the last measurement. Timestamps are the primary key of everything downstream, so with skew
+// over ClockSkewMax snapshots are not written at all.
+type clockSkew struct {
+	sync.Mutex
+	measured bool
+	skew     time.Duration
+}
+
+var skew = &clockSkew{}
+
+// measureClockSkew compares local time with now() of ClickHouse. now() has a resolution of a second and half of
+// the round trip is attributed to each direction, so skew under a second is noise.
+func measureClockSkew(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	t0 := time.Now()
+	var remote time.Time
+	err := config.db.QueryRowContext(ctx, "SELECT now()").Scan(&remote)
+	if err != nil {
+		return 0, err
+	}
+	t1 := time.Now()
+	local := t0.Add(t1.Sub(t0) / 2)
+	return local.Sub(remote).Truncate(time.Second), nil
+}
+
+// update measures skew and logs it, warning above ClockSkewWarn
+func (s *clockSkew) update(ctx context.Context) {
+	d, err := measureClockSkew(ctx)
+	if err != nil {
+		logger.Warn("failed to measure clock skew",
+			zap.Error(err),
+		)
+		return
+	}
+	s.Lock()
+	s.measured, s.skew = true, d
+	s.Unlock()
+	clockSkewMs.Set(d.Nanoseconds() / int64(time.Millisecond))
+
+	fields := []zapcore.Field{
+		zap.Duration("skew", d),
+		zap.Duration("warn_above", config.ClockSkewWarn),
+		zap.Duration("max", config.ClockSkewMax),
+	}
+	switch {
+	case config.ClockSkewMax > 0 && abs(d) > config.ClockSkewMax:
+		logger.Error("clock skew with clickhouse is over the limit, snapshots won't be written", fields...)
+	case config.ClockSkewWarn > 0 && abs(d) > config.ClockSkewWarn:
+		logger.Warn("clock skew with clickhouse", fields...)
+	default:
+		logger.Debug("clock skew with clickhouse", fields...)
+	}
+}
+
+// check returns an error if snapshots must not be written because of skew. Skew that was never measured doesn't
+// block writes, measurement failures are already reported by update.
+func (s *clockSkew) check() error {
+	s.Lock()
+	measured, d := s.measured, s.skew
+	s.Unlock()
+	if measured && config.ClockSkewMax > 0 && abs(d) > config.ClockSkewMax {
+		return fmt.Errorf("clock skew %v with clickhouse is over %v", d, config.ClockSkewMax)
+	}
+	return nil
+}
+
+// metadata returns the last measured skew in milliseconds, or empty string if it wasn't measured
+func (s *clockSkew) metadata() string {
+	s.Lock()
+	defer s.Unlock()
+	if !s.measured {
+		return ""
+	}
+	return strconv.FormatInt(s.skew.Nanoseconds()/int64(time.Millisecond), 10)
+}
+
+// keepMeasuringClockSkew updates skew every ClockSkewCheckInterval until ctx is canceled
+func keepMeasuringClockSkew(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for sleepContext(ctx, interval) {
+		skew.update(ctx)
+	}
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	pb "github.com/go-graphite/carbonzipper/carbonzipperpb3"
+)
+
+// structureHashKey is the snapshot metadata key of the hash of the set of metric paths
+const structureHashKey = "structure_hash"
+
+// structureHash identifies the set of metric paths regardless of their sizes and counts
+func structureHash(details *pb.MetricDetailsResponse) string {
+	names := make([]string, 0, len(details.Metrics))
+	for name := range details.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// structureHashes keeps structure hash of the last stored snapshot per cluster. It lives in memory only, so the
+// first snapshot after restart is always stored.
+type structureHashes struct {
+	sync.Mutex
+	hashes map[string]string
+}
+
+var lastStructures = &structureHashes{hashes: make(map[string]string)}
+
+func (s *structureHashes) get(cluster string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.hashes[cluster]
+}
+
+func (s *structureHashes) set(cluster, hash string) {
+	s.Lock()
+	s.hashes[cluster] = hash
+	s.Unlock()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// httpClients are clients to fetch metric lists with, by cluster name. They are built once at startup, so
+// connections are reused between iterations and broken TLS settings are found before the first fetch.
+var httpClients map[string]*http.Client
+
+// defaultFetchTimeout is used for clusters without FetchTimeout
+const defaultFetchTimeout = 120 * time.Second
+
+func newHTTPClients(clusters []types.Cluster) (map[string]*http.Client, error) {
+	res := make(map[string]*http.Client, len(clusters))
+	for i := range clusters {
+		c, err := newHTTPClient(&clusters[i])
+		if err != nil {
+			return nil, fmt.Errorf("cluster %v: %v", clusters[i].Name, err)
+		}
+		res[clusters[i].Name] = c
+	}
+	return res, nil
+}
+
+func newHTTPClient(cluster *types.Cluster) (*http.Client, error) {
+	timeout := cluster.FetchTimeout
+	if timeout == 0 {
+		timeout = defaultFetchTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	cfg := cluster.TLS
+	if cfg == nil {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+type bulkRequest struct {
+	Cluster  string  `json:"cluster"`
+	Ts       int64   `json:"ts"`
+	MinPct   float64 `json:"min_pct"`
+	MinValue int64   `json:"min_value"`
+}
+
+type bulkResponse struct {
+	Cluster string                `json:"cluster"`
+	Ts      int64                 `json:"ts"`
+	Tree    *types.FlameGraphNode `json:"tree,omitempty"`
+	Error   string                `json:"error,omitempty"`
+}
+
+// Handler for the request POST /bulk with body [{"cluster": "cluster", "ts": timestamp, "min_pct": 0.1}, ...]
+// Responses are returned in the same order as requests. Failure of one of the requests doesn't affect the others.
+func bulkHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "bulk"))
+
+	if req.Method == http.MethodOptions {
+		// CORS preflight, headers are already set
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		logger.Error("Only POST is supported",
+			zap.String("method", req.Method),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusMethodNotAllowed),
+		)
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requests []bulkRequest
+	err := json.NewDecoder(req.Body).Decode(&requests)
+	if err != nil {
+		logger.Error("Error parsing request",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+			zap.Error(err),
+		)
+		http.Error(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	if len(requests) > config.MaxBulkRequests {
+		logger.Error("Too many requests in a batch",
+			zap.Int("requests", len(requests)),
+			zap.Int("max_bulk_requests", config.MaxBulkRequests),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusRequestEntityTooLarge),
+		)
+		http.Error(w, "Too many requests in a batch", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx := req.Context()
+	responses := make([]bulkResponse, len(requests))
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func(i int, r bulkRequest) {
+			defer wg.Done()
+			// recoverPanic middleware can't catch panics in other goroutines
+			defer func() {
+				if rec := recover(); rec != nil {
+					handlerPanics.Add(1)
+					logger.Error("panic while serving request",
+						zap.Any("panic", rec),
+						zap.Stack("stack"),
+					)
+					responses[i].Tree = nil
+					responses[i].Error = "Internal server error"
+				}
+			}()
+			responses[i].Cluster = r.Cluster
+			responses[i].Ts = r.Ts
+			if r.Cluster == "" || r.Ts == 0 {
+				responses[i].Error = "You must specify cluster and ts"
+				return
+			}
+
+			if r.MinPct != 0 && r.MinValue != 0 {
+				responses[i].Error = "Only one of min_pct or min_value can be specified"
+				return
+			}
+
+			removeLowest, minValue := trimmingFor(r.Cluster)
+			if r.MinPct != 0 {
+				removeLowest = r.MinPct / 100
+				minValue = 0
+			}
+			if r.MinValue != 0 {
+				removeLowest = 0
+				minValue = r.MinValue
+			}
+			// Items are shed one by one like /get would shed them, so /bulk is not a way around admission control
+			if trimmedTooLittle(removeLowest, minValue) && overloaded() {
+				requestsShed.Add("bulk_untrimmed", 1)
+				responses[i].Error = "ClickHouse is overloaded, try again later or request a trimmed graph"
+				return
+			}
+
+			// getTree takes care of the concurrency limit
+			tree, err := getTree(ctx, &treeRequest{
+				cluster:      r.Cluster,
+				ts:           r.Ts,
+				maxLevel:     defaultMaxLevel,
+				column:       "value",
+				removeLowest: removeLowest,
+				minValue:     minValue,
+			})
+			if err != nil {
+				responses[i].Error = err.Error()
+				return
+			}
+			responses[i].Tree = tree
+		}(i, requests[i])
+	}
+	wg.Wait()
+
+	if clientGone(ctx) {
+		logAbandoned(logger, t0, ctx.Err())
+		return
+	}
+
+	b, err := json.Marshal(responses)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Int("requests", len(requests)),
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestBulkHandlerRejectsRequest(t *testing.T) {
+	logger = zap.NewNop()
+	config.MaxBulkRequests = 2
+	defer func() { config.MaxBulkRequests = 0 }()
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		code   int
+	}{
+		{name: "GET", method: "GET", code: http.StatusMethodNotAllowed},
+		{name: "invalid JSON", method: "POST", body: `{"cluster": "a"`, code: http.StatusBadRequest},
+		{name: "not an array", method: "POST", body: `{"cluster": "a", "ts": 1}`, code: http.StatusBadRequest},
+		{name: "too many requests", method: "POST", body: `[{"cluster": "a", "ts": 1}, {"cluster": "a", "ts": 2}, {"cluster": "a", "ts": 3}]`, code: http.StatusRequestEntityTooLarge},
+		{name: "CORS preflight", method: "OPTIONS", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			bulkHandler(w, httptest.NewRequest(tt.method, "/bulk", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Errorf("expected %v, got %v: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// Every item of the batch is answered without ClickHouse: invalid ones are rejected and the rest are shed
+func TestBulkHandlerRespondsInOrder(t *testing.T) {
+	logger = zap.NewNop()
+	config.MaxBulkRequests = 10
+	config.LoadShedding = loadSheddingConfig{CheckInterval: time.Minute, MinRemoveLowestPct: 5}
+	loadState.Lock()
+	loadState.Overloaded = true
+	loadState.Unlock()
+	defer func() {
+		config.MaxBulkRequests = 0
+		config.LoadShedding = loadSheddingConfig{}
+		loadState.Lock()
+		loadState.Overloaded = false
+		loadState.Unlock()
+	}()
+
+	const shedError = "ClickHouse is overloaded, try again later or request a trimmed graph"
+	tests := []struct {
+		req   bulkRequest
+		error string
+	}{
+		{req: bulkRequest{Cluster: "a"}, error: "You must specify cluster and ts"},
+		{req: bulkRequest{Cluster: "b", Ts: 1, MinPct: 1, MinValue: 2}, error: "Only one of min_pct or min_value can be specified"},
+		{req: bulkRequest{Cluster: "c", Ts: 2}, error: shedError},
+		{req: bulkRequest{Cluster: "d", Ts: 3, MinPct: 1}, error: shedError},
+		{req: bulkRequest{Ts: 4}, error: "You must specify cluster and ts"},
+	}
+	requests := make([]bulkRequest, 0, len(tests))
+	for _, tt := range tests {
+		requests = append(requests, tt.req)
+	}
+	body, err := json.Marshal(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shedBefore := shedCount("bulk_untrimmed")
+
+	w := httptest.NewRecorder()
+	bulkHandler(w, httptest.NewRequest("POST", "/bulk", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %v, got %v: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var responses []bulkResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != len(tests) {
+		t.Fatalf("expected %v responses, got %v", len(tests), len(responses))
+	}
+	for i, tt := range tests {
+		r := responses[i]
+		if r.Cluster != tt.req.Cluster || r.Ts != tt.req.Ts {
+			t.Errorf("response %v: expected %v@%v, got %v@%v", i, tt.req.Cluster, tt.req.Ts, r.Cluster, r.Ts)
+		}
+		if r.Error != tt.error || r.Tree != nil {
+			t.Errorf("response %v: expected error %q, got %q", i, tt.error, r.Error)
+		}
+	}
+	if shed := shedCount("bulk_untrimmed") - shedBefore; shed != 2 {
+		t.Errorf("expected 2 items to be shed, got %v", shed)
+	}
+}
+
+func shedCount(class string) int64 {
+	v, ok := requestsShed.Get(class).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
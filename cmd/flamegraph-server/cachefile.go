@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Trees in the query cache are dumped to CacheFile, so after restart they are served from memory instead of
+// being reconstructed by ClickHouse right when all the dashboards reconnect.
+//
+// File layout: magic, format version (uint32), CRC32 of the payload (uint32), gob encoded cacheFile.
+const (
+	cacheFileMagic   = "FGCACHE"
+	cacheFileVersion = uint32(1)
+)
+
+// persistedPrefix selects cache entries that are worth persisting, other responses are cheap to rebuild
+const persistedPrefix = "get&"
+
+type cacheFile struct {
+	Created time.Time
+	// TreeFormatVersion is treeFormatVersion of the cached responses. Files written before it was recorded have 0.
+	TreeFormatVersion int
+	Entries           []cacheFileEntry
+}
+
+type cacheFileEntry struct {
+	Key     string
+	Value   []byte
+	Expires time.Time
+}
+
+// cacheIndex remembers keys of persisted entries, as expirecache can't be iterated
+type cacheIndex struct {
+	sync.Mutex
+	expires map[string]time.Time
+}
+
+func (ec expireCache) remember(k string, expire int32) {
+	if ec.index == nil || !strings.HasPrefix(k, persistedPrefix) {
+		return
+	}
+	ec.index.Lock()
+	ec.index.expires[k] = time.Now().Add(time.Duration(expire) * time.Second)
+	ec.index.Unlock()
+}
+
+// snapshot returns entries that are still in the cache and forgets the rest
+func (ec expireCache) snapshot() []cacheFileEntry {
+	ec.index.Lock()
+	defer ec.index.Unlock()
+
+	now := time.Now()
+	res := make([]cacheFileEntry, 0, len(ec.index.expires))
+	for k, expires := range ec.index.expires {
+		v, ok := ec.get(k)
+		if !ok || expires.Before(now) {
+			delete(ec.index.expires, k)
+			continue
+		}
+		res = append(res, cacheFileEntry{Key: k, Value: v, Expires: expires})
+	}
+	return res
+}
+
+func (ec expireCache) save(path string) error {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(cacheFile{
+		Created:           time.Now(),
+		TreeFormatVersion: treeFormatVersion,
+		Entries:           ec.snapshot(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(cacheFileMagic)
+	binary.Write(&buf, binary.LittleEndian, cacheFileVersion)
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	buf.Write(payload.Bytes())
+
+	// Write to a temporary file first so crash in the middle doesn't leave a truncated cache behind
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readCacheFile(path string) (*cacheFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	headerLen := len(cacheFileMagic) + 8
+	if len(data) < headerLen || string(data[:len(cacheFileMagic)]) != cacheFileMagic {
+		return nil, errors.New("not a cache file")
+	}
+	version := binary.LittleEndian.Uint32(data[len(cacheFileMagic):])
+	if version != cacheFileVersion {
+		return nil, errors.New("unsupported cache file version")
+	}
+	checksum := binary.LittleEndian.Uint32(data[len(cacheFileMagic)+4:])
+	payload := data[headerLen:]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	f := &cacheFile{}
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load fills the cache from the file. Missing, corrupt or stale files are ignored.
+func (ec expireCache) load(path string, maxAge time.Duration) {
+	logger := logger.With(zap.String("cache_file", path))
+
+	f, err := readCacheFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("ignoring cache file",
+				zap.Error(err),
+			)
+		}
+		return
+	}
+	if f.TreeFormatVersion != treeFormatVersion {
+		logger.Warn("ignoring cache file with trees in another format",
+			zap.Int("format_version", f.TreeFormatVersion),
+			zap.Int("supported_format_version", treeFormatVersion),
+		)
+		return
+	}
+	if time.Since(f.Created) > maxAge {
+		logger.Warn("ignoring stale cache file",
+			zap.Time("created", f.Created),
+		)
+		return
+	}
+
+	loaded := 0
+	now := time.Now()
+	for _, e := range f.Entries {
+		// An entry from a host with a skewed clock shouldn't overflow into an already expired one
+		expire := int32(math.MaxInt32)
+		if ttl := e.Expires.Sub(now).Seconds(); ttl < math.MaxInt32 {
+			expire = int32(ttl)
+		}
+		if expire <= 0 {
+			continue
+		}
+		ec.set(e.Key, e.Value, expire)
+		loaded++
+	}
+	logger.Info("cache loaded",
+		zap.Int("entries", loaded),
+		zap.Time("created", f.Created),
+	)
+}
+
+func saveCache(path string) {
+	err := config.queryCache.save(path)
+	if err != nil {
+		logger.Error("failed to save cache file",
+			zap.String("cache_file", path),
+			zap.Error(err),
+		)
+	}
+}
+
+// persistCache saves the cache every interval. It's also saved on shutdown, after requests are drained.
+func persistCache(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		saveCache(path)
+	}
+}
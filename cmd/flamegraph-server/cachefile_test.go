@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ecache "github.com/dgryski/go-expirecache"
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// Fixtures in testdata are cache files written by every treeFormatVersion so far and by a future one. They hold a
+// single /get response of testTree under fixtureKey and are never rewritten: a change that makes the server
+// misread an old file must fail here.
+const fixtureKey = "get&fixture"
+
+// fixtureMaxAge keeps the fixtures from being ignored as stale
+const fixtureMaxAge = 100 * 365 * 24 * time.Hour
+
+func TestReadCacheFileFixtures(t *testing.T) {
+	tests := []struct {
+		file    string
+		version int
+	}{
+		{file: "cache_v0.bin", version: 0},
+		{file: "cache_v1.bin", version: 1},
+		{file: "cache_v2.bin", version: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := readCacheFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.TreeFormatVersion != tt.version {
+				t.Errorf("expected tree format version %v, got %v", tt.version, f.TreeFormatVersion)
+			}
+			if len(f.Entries) != 1 || f.Entries[0].Key != fixtureKey {
+				t.Fatalf("unexpected entries %+v", f.Entries)
+			}
+		})
+	}
+}
+
+func TestLoadCacheFileFixtures(t *testing.T) {
+	logger = zap.NewNop()
+	tests := []struct {
+		file   string
+		loaded bool
+	}{
+		// Written before the version was recorded, the trees may be in any format
+		{file: "cache_v0.bin", loaded: false},
+		{file: "cache_v1.bin", loaded: true},
+		{file: "cache_v2.bin", loaded: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			ec := expireCache{ec: ecache.New(1 << 20)}
+			ec.load(filepath.Join("testdata", tt.file), fixtureMaxAge)
+
+			b, ok := ec.get(fixtureKey)
+			if ok != tt.loaded {
+				t.Fatalf("expected loaded=%v, got %v", tt.loaded, ok)
+			}
+			if !ok {
+				return
+			}
+			var tree types.FlameGraphNode
+			if err := json.Unmarshal(b, &tree); err != nil {
+				t.Fatal(err)
+			}
+			if tree.FormatVersion != treeFormatVersion {
+				t.Errorf("expected formatVersion %v in the body, got %v", treeFormatVersion, tree.FormatVersion)
+			}
+			if tree.Name != "[disk]" || tree.Value != 100 || len(tree.Children) != 3 {
+				t.Errorf("unexpected tree %s", b)
+			}
+		})
+	}
+}
+
+func TestLoadStaleCacheFile(t *testing.T) {
+	logger = zap.NewNop()
+	ec := expireCache{ec: ecache.New(1 << 20)}
+	ec.load(filepath.Join("testdata", "cache_v1.bin"), time.Hour)
+	if _, ok := ec.get(fixtureKey); ok {
+		t.Error("expected stale cache file to be ignored")
+	}
+}
+
+func TestReadCacheFileErrors(t *testing.T) {
+	valid, err := ioutil.ReadFile(filepath.Join("testdata", "cache_v1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(f func(b []byte) []byte) []byte {
+		b := append([]byte(nil), valid...)
+		return f(b)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{name: "empty", data: nil, err: "not a cache file"},
+		{name: "bad magic", data: corrupt(func(b []byte) []byte { b[0] = 'X'; return b }), err: "not a cache file"},
+		{name: "unsupported file version", data: corrupt(func(b []byte) []byte { b[len(cacheFileMagic)] = 2; return b }), err: "unsupported cache file version"},
+		{name: "checksum mismatch", data: corrupt(func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }), err: "checksum mismatch"},
+		{name: "truncated", data: valid[:len(valid)-10], err: "checksum mismatch"},
+	}
+	dir, err := ioutil.TempDir("", "cachefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tt.name, " ", "_", -1))
+			if err := ioutil.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readCacheFile(path)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	logger = zap.NewNop()
+	dir, err := ioutil.TempDir("", "cachefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+
+	src := expireCache{ec: ecache.New(1 << 20), index: &cacheIndex{expires: make(map[string]time.Time)}}
+	src.set(fixtureKey, []byte(`{"name":"[disk]"}`), 60)
+	src.set("other&key", []byte("not persisted"), 60)
+	if err := src.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := expireCache{ec: ecache.New(1 << 20)}
+	dst.load(path, time.Hour)
+	if b, ok := dst.get(fixtureKey); !ok || string(b) != `{"name":"[disk]"}` {
+		t.Errorf("expected %q to be restored, got %q", fixtureKey, b)
+	}
+	if _, ok := dst.get("other&key"); ok {
+		t.Error("expected only /get responses to be persisted")
+	}
+}
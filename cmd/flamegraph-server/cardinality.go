@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+type snapshotCardinality struct {
+	Cluster   string
+	Timestamp int64
+	// Truncated is set if collector stored only the largest children of some nodes, counts are lower bounds then
+	Truncated  bool
+	Namespaces []namespaceCardinality
+}
+
+type namespaceCardinality struct {
+	Name string
+	// Leaves is amount of unique metric paths under the namespace
+	Leaves int64
+}
+
+// countLeaves returns amount of leaves under the node and whether any node of the subtree was truncated
+func countLeaves(node *types.FlameGraphNode) (int64, bool) {
+	if len(node.ChildrenIds) == 0 {
+		return 1, node.ChildrenTruncated
+	}
+	leaves, truncated := int64(0), node.ChildrenTruncated
+	for _, c := range node.Children {
+		l, t := countLeaves(c)
+		leaves += l
+		truncated = truncated || t
+	}
+	return leaves, truncated
+}
+
+// getCardinality reconstructs the whole tree of the snapshot and counts metrics under every top-level node.
+// Service nodes like '[free]' are not namespaces and are skipped. Empty metrics aren't stored with a value, so
+// they are not counted.
+func getCardinality(ctx context.Context, cluster string, ts int64) (*snapshotCardinality, error) {
+	tree, err := getTree(ctx, &treeRequest{
+		cluster:  cluster,
+		ts:       ts,
+		maxLevel: math.MaxInt32,
+		column:   "value",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &snapshotCardinality{
+		Cluster:    cluster,
+		Timestamp:  ts,
+		Truncated:  tree.ChildrenTruncated,
+		Namespaces: []namespaceCardinality{},
+	}
+	for _, c := range tree.Children {
+		if strings.HasPrefix(c.Name, "[") {
+			continue
+		}
+		leaves, truncated := countLeaves(c)
+		res.Truncated = res.Truncated || truncated
+		res.Namespaces = append(res.Namespaces, namespaceCardinality{Name: c.Name, Leaves: leaves})
+	}
+	sort.Slice(res.Namespaces, func(i, j int) bool {
+		if res.Namespaces[i].Leaves != res.Namespaces[j].Leaves {
+			return res.Namespaces[i].Leaves > res.Namespaces[j].Leaves
+		}
+		return res.Namespaces[i].Name < res.Namespaces[j].Name
+	})
+	return res, nil
+}
+
+// Handler for the request /cardinality?cluster=cluster&ts=timestamp
+// Returns amount of metrics per top-level namespace, largest first
+func cardinalityHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	ctx := req.Context()
+	logger := requestLogger(ctx, "cardinality")
+
+	cluster := req.FormValue("cluster")
+	ts := req.FormValue("ts")
+	if cluster == "" || ts == "" {
+		logger.Error("You must specify cluster and ts",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("timestamp", ts),
+	)
+
+	tsInt, err := parseTime(ts, t0)
+	if err != nil {
+		logger.Error("Error parsing ts",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cacheKey := "cardinality&" + cluster + "&" + strconv.FormatInt(tsInt, 10)
+	if response, ok := config.queryCache.get(cacheKey); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+		logger.Info("request served",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusOK),
+		)
+		return
+	}
+
+	if shedIfOverloaded(w, logger, "cardinality", t0) {
+		return
+	}
+
+	cardinality, err := getCardinality(ctx, cluster, tsInt)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error fetching data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(cardinality)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+	config.queryCache.set(cacheKey, b, config.CacheTimeoutSeconds)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const formatCollapsed = "collapsed"
+
+// collapsedEscaper replaces characters that have a meaning in the folded stack format
+var collapsedEscaper = strings.NewReplacer(";", "_", "\n", "_", "\r", "_")
+
+// writeCollapsed writes the tree in folded stack format ("a;b;c value") understood by flamegraph.pl and speedscope.
+// Tools sum the lines to size the frames, so a line holds the value of a node that isn't covered by its children:
+// the whole value for leaves and the rest for nodes which children were trimmed. Lines with no value are skipped.
+// It stops as soon as writing fails or ctx is canceled.
+func writeCollapsed(ctx context.Context, w io.Writer, root *types.FlameGraphNode) error {
+	bw := bufio.NewWriter(w)
+	var stack []string
+	rows := 0
+	var walk func(n *types.FlameGraphNode) error
+	walk = func(n *types.FlameGraphNode) error {
+		if rows%streamCheckRows == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rows++
+		stack = append(stack, collapsedEscaper.Replace(n.Name))
+		self := n.Value
+		for _, c := range n.Children {
+			self -= c.Value
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		if self > 0 {
+			bw.WriteString(strings.Join(stack, ";"))
+			bw.WriteByte(' ')
+			bw.WriteString(strconv.FormatInt(self, 10))
+			if err := bw.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
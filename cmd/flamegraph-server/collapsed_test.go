@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+func TestWriteCollapsed(t *testing.T) {
+	tests := []struct {
+		name     string
+		root     func() *types.FlameGraphNode
+		expected string
+	}{
+		{
+			// a is 60 but its children only cover 55, the rest is its own line. [disk] is fully covered.
+			name: "whole tree",
+			root: testTree,
+			expected: "[disk];[free] 10\n" +
+				"[disk];a;b;c 40\n" +
+				"[disk];a;d 15\n" +
+				"[disk];a 5\n" +
+				"[disk];e 30\n",
+		},
+		{
+			name: "subtree",
+			root: func() *types.FlameGraphNode { return testTree().Children[1] },
+			expected: "a;b;c 40\n" +
+				"a;d 15\n" +
+				"a 5\n",
+		},
+		{
+			// Children of b were trimmed, so its whole value is its own
+			name: "trimmed children",
+			root: func() *types.FlameGraphNode {
+				root := testTree()
+				root.Children[1].Children[0].Children = nil
+				return root
+			},
+			expected: "[disk];[free] 10\n" +
+				"[disk];a;b 40\n" +
+				"[disk];a;d 15\n" +
+				"[disk];a 5\n" +
+				"[disk];e 30\n",
+		},
+		{
+			name: "escaped names",
+			root: func() *types.FlameGraphNode {
+				root := &types.FlameGraphNode{Name: "[disk]", Value: 3}
+				root.Children = []*types.FlameGraphNode{
+					{Name: "a;b", Value: 1, Parent: root},
+					{Name: "c\nd\re", Value: 2, Parent: root},
+				}
+				return root
+			},
+			expected: "[disk];a_b 1\n" +
+				"[disk];c_d_e 2\n",
+		},
+		{
+			name:     "empty tree",
+			root:     func() *types.FlameGraphNode { return &types.FlameGraphNode{Name: "[disk]"} },
+			expected: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeCollapsed(context.Background(), &buf, tt.root()); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("unexpected output:\n got: %q\nwant: %q", buf.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteCollapsedStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	if err := writeCollapsed(ctx, &buf, wideTree(100000)); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be written for a canceled request, got %v bytes", buf.Len())
+	}
+
+	w := &brokenWriter{}
+	if err := writeCollapsed(context.Background(), w, wideTree(100000)); err != errBrokenPipe {
+		t.Errorf("expected %v, got %v", errBrokenPipe, err)
+	}
+	if w.writes != 2 {
+		t.Errorf("expected writing to stop at the first failed write, got %v writes", w.writes)
+	}
+}
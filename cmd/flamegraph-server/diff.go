@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// diffNode is a node that is present in at least one of two compared snapshots
+type diffNode struct {
+	Name string `json:"name"`
+	// Value is max(Value1, Value2), so the layout of the graph doesn't jump between the snapshots
+	Value  int64 `json:"value"`
+	Value1 int64 `json:"value1"`
+	Value2 int64 `json:"value2"`
+	// Rank1 and Rank2 are positions among siblings when they are ordered by Value1 (Value2), -1 if node is missing
+	Rank1    int         `json:"rank1"`
+	Rank2    int         `json:"rank2"`
+	Children []*diffNode `json:"children,omitempty"`
+
+	in1 bool
+	in2 bool
+}
+
+// diffTrees merges two trees by node names. Either of the trees can be nil
+func diffTrees(n1, n2 *types.FlameGraphNode) *diffNode {
+	res := &diffNode{
+		Rank1: -1,
+		Rank2: -1,
+	}
+	byName := make(map[string][2]*types.FlameGraphNode)
+	var names []string
+	if n1 != nil {
+		res.in1 = true
+		res.Name = n1.Name
+		res.Value1 = n1.Value
+		for _, c := range n1.Children {
+			v, ok := byName[c.Name]
+			if !ok {
+				names = append(names, c.Name)
+			}
+			v[0] = c
+			byName[c.Name] = v
+		}
+	}
+	if n2 != nil {
+		res.in2 = true
+		res.Name = n2.Name
+		res.Value2 = n2.Value
+		for _, c := range n2.Children {
+			v, ok := byName[c.Name]
+			if !ok {
+				names = append(names, c.Name)
+			}
+			v[1] = c
+			byName[c.Name] = v
+		}
+	}
+	res.Value = res.Value1
+	if res.Value2 > res.Value {
+		res.Value = res.Value2
+	}
+
+	for _, name := range names {
+		v := byName[name]
+		res.Children = append(res.Children, diffTrees(v[0], v[1]))
+	}
+
+	setRanks(res.Children)
+	// Order by the maximum of two values, so frames keep their relative position in both snapshots
+	sortDiffNodes(res.Children, func(n *diffNode) int64 { return n.Value })
+
+	return res
+}
+
+func sortDiffNodes(nodes []*diffNode, value func(n *diffNode) int64) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if value(nodes[i]) != value(nodes[j]) {
+			return value(nodes[i]) > value(nodes[j])
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+}
+
+func setRanks(nodes []*diffNode) {
+	sorted := make([]*diffNode, len(nodes))
+	copy(sorted, nodes)
+
+	sortDiffNodes(sorted, func(n *diffNode) int64 { return n.Value1 })
+	rank := 0
+	for _, n := range sorted {
+		if n.in1 {
+			n.Rank1 = rank
+			rank++
+		}
+	}
+
+	sortDiffNodes(sorted, func(n *diffNode) int64 { return n.Value2 })
+	rank = 0
+	for _, n := range sorted {
+		if n.in2 {
+			n.Rank2 = rank
+			rank++
+		}
+	}
+}
+
+// Handler for the request /diff?cluster=cluster&ts1=timestamp&ts2=timestamp
+func diffHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "diff"))
+
+	cluster := req.FormValue("cluster")
+	ts1Str := req.FormValue("ts1")
+	ts2Str := req.FormValue("ts2")
+	if cluster == "" || ts1Str == "" || ts2Str == "" {
+		logger.Error("You must specify cluster, ts1 and ts2",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'cluster', 'ts1' or 'ts2'", http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("ts1", ts1Str),
+		zap.String("ts2", ts2Str),
+	)
+
+	ts1, err := parseTime(ts1Str, t0)
+	ts2 := int64(0)
+	if err == nil {
+		ts2, err = parseTime(ts2Str, t0)
+	}
+	if err != nil {
+		logger.Error("Error parsing ts1 or ts2",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts1' or 'ts2': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	var warnings []string
+	oldest, err := oldestAvailable(ctx, cluster, defaultGraphType)
+	if err != nil {
+		logger.Warn("failed to get oldest available snapshot",
+			zap.Error(err),
+		)
+	} else if oldest > 0 && (ts1 < oldest || ts2 < oldest) {
+		// Comparing with the oldest snapshot is more useful than an error or an empty tree
+		if ts1 < oldest {
+			ts1 = oldest
+		}
+		if ts2 < oldest {
+			ts2 = oldest
+		}
+		warnings = append(warnings, "snapshots older than "+strconv.FormatInt(oldest, 10)+" expired, range was clamped to it")
+	}
+
+	removeLowest, minValue := trimmingFor(cluster)
+	var trees [2]*types.FlameGraphNode
+	for i, ts := range []int64{ts1, ts2} {
+		var err error
+		trees[i], err = getTree(ctx, &treeRequest{
+			cluster:      cluster,
+			ts:           ts,
+			maxLevel:     defaultMaxLevel,
+			column:       "value",
+			removeLowest: removeLowest,
+			minValue:     minValue,
+		})
+		if err != nil {
+			if clientGone(ctx) {
+				logAbandoned(logger, t0, err)
+				return
+			}
+			requestsFailed.Add(1)
+			logger.Error("Error fetching data",
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.Error(err),
+			)
+			http.Error(w, "Error fetching data",
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	metadata1, err1 := getSnapshotMetadata(ctx, defaultGraphType, cluster, ts1)
+	metadata2, err2 := getSnapshotMetadata(ctx, defaultGraphType, cluster, ts2)
+	if err1 == nil && err2 == nil && metadata1["config_hash"] != metadata2["config_hash"] {
+		logger.Warn("comparing snapshots built with different settings",
+			zap.Any("metadata1", metadata1),
+			zap.Any("metadata2", metadata2),
+		)
+		warning := "snapshots were built with different settings"
+		if metadata1["query_prefixes"] != metadata2["query_prefixes"] {
+			// Everything outside of the restricted snapshot's prefixes would show up as removed or added
+			warning = "snapshots cover different parts of the namespace (query_prefixes differ)"
+		}
+		warnings = append(warnings, warning)
+	}
+	if len(warnings) > 0 {
+		w.Header().Set("X-Flamegraph-Warning", strings.Join(warnings, "; "))
+	}
+
+	root := diffTrees(trees[0], trees[1])
+	root.Rank1 = 0
+	root.Rank2 = 0
+
+	b, err := json.Marshal(root)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// diffSummary counts differences between two snapshots, nodes are matched by their full path
+type diffSummary struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	// Changed are nodes present in both snapshots with different values
+	Changed int `json:"changed"`
+	Total1  int `json:"total1"`
+	Total2  int `json:"total2"`
+}
+
+// getSnapshotPaths returns values of all nodes of the snapshot by their full path. Ids are assigned by collector
+// per snapshot, so they can't be compared between snapshots, paths can.
+func getSnapshotPaths(ctx context.Context, cluster string, ts int64) (map[string]int64, error) {
+	date := time.Unix(ts, 0).Format("2006-01-02")
+	rows, err := config.db.QueryContext(ctx, "SELECT id, any(parent_id), any(name), sum(value) FROM flamegraph WHERE graph_type=? AND cluster=? AND timestamp=? AND date=? group by id", defaultGraphType, cluster, ts, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make(map[int64]helper.ChecksumNode)
+	for rows.Next() {
+		var n helper.ChecksumNode
+		err = rows.Scan(&n.Id, &n.ParentID, &n.Name, &n.Value)
+		if err != nil {
+			return nil, err
+		}
+		nodes[n.Id] = n
+		if len(nodes)%helper.MemoryCheckInterval == 0 {
+			if err := helper.CheckMemoryLimit(config.MemoryLimitMB); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	accountRows(ctx, int64(len(nodes)))
+
+	paths := make(map[int64]string, len(nodes))
+	var pathOf func(id int64) string
+	pathOf = func(id int64) string {
+		if p, ok := paths[id]; ok {
+			return p
+		}
+		n := nodes[id]
+		p := n.Name
+		if _, ok := nodes[n.ParentID]; ok && id != types.RootElementId {
+			p = pathOf(n.ParentID) + types.FieldSeparator + n.Name
+		}
+		paths[id] = p
+		return p
+	}
+
+	res := make(map[string]int64, len(nodes))
+	for id, n := range nodes {
+		res[pathOf(id)] = n.Value
+	}
+	return res, nil
+}
+
+func summarizeDiff(paths1, paths2 map[string]int64) diffSummary {
+	res := diffSummary{
+		Total1: len(paths1),
+		Total2: len(paths2),
+	}
+	for p, v1 := range paths1 {
+		v2, ok := paths2[p]
+		switch {
+		case !ok:
+			res.Removed++
+		case v1 != v2:
+			res.Changed++
+		}
+	}
+	for p := range paths2 {
+		if _, ok := paths1[p]; !ok {
+			res.Added++
+		}
+	}
+	return res
+}
+
+// Handler for the request /diffsummary?cluster=cluster&ts1=timestamp&ts2=timestamp
+// Returns only counts of added, removed and changed nodes, without building the merged tree
+func diffSummaryHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "diffsummary"))
+
+	cluster := req.FormValue("cluster")
+	ts1Str := req.FormValue("ts1")
+	ts2Str := req.FormValue("ts2")
+	if cluster == "" || ts1Str == "" || ts2Str == "" {
+		logger.Error("You must specify cluster, ts1 and ts2",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'cluster', 'ts1' or 'ts2'", http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("ts1", ts1Str),
+		zap.String("ts2", ts2Str),
+	)
+
+	ts1, err := parseTime(ts1Str, t0)
+	ts2 := int64(0)
+	if err == nil {
+		ts2, err = parseTime(ts2Str, t0)
+	}
+	if err != nil {
+		logger.Error("Error parsing ts1 or ts2",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts1' or 'ts2': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	var paths [2]map[string]int64
+	for i, ts := range []int64{ts1, ts2} {
+		paths[i], err = getSnapshotPaths(ctx, cluster, ts)
+		if err != nil {
+			if clientGone(ctx) {
+				logAbandoned(logger, t0, err)
+				return
+			}
+			requestsFailed.Add(1)
+			logger.Error("Error fetching data",
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.Error(err),
+			)
+			http.Error(w, "Error fetching data",
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	b, err := json.Marshal(summarizeDiff(paths[0], paths[1]))
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const formatDOT = "dot"
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", ``)
+
+// dotQuote makes a DOT quoted string. DOT files are UTF-8 by default, so only quotes, backslashes and line breaks
+// need escaping.
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+func countNodes(n *types.FlameGraphNode) int {
+	res := 1
+	for _, c := range n.Children {
+		res += countNodes(c)
+	}
+	return res
+}
+
+// renderDOT renders the tree as a Graphviz digraph with edges from parents to children. Node ids are assigned
+// in pre-order, as synthetic nodes don't have ids of their own.
+func renderDOT(root *types.FlameGraphNode) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph flamegraph {\n\tnode [shape=box];\n")
+	next := 0
+	var walk func(n *types.FlameGraphNode) int
+	walk = func(n *types.FlameGraphNode) int {
+		id := next
+		next++
+		fmt.Fprintf(&buf, "\tn%d [label=%s];\n", id, dotQuote(fmt.Sprintf("%s\n%d", n.Name, n.Value)))
+		for _, c := range n.Children {
+			childID := walk(c)
+			fmt.Fprintf(&buf, "\tn%d -> n%d;\n", id, childID)
+		}
+		return id
+	}
+	walk(root)
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+func TestRenderDOT(t *testing.T) {
+	tests := []struct {
+		name     string
+		root     *types.FlameGraphNode
+		expected string
+	}{
+		{
+			name: "whole tree",
+			root: testTree(),
+			expected: `digraph flamegraph {
+	node [shape=box];
+	n0 [label="[disk]\n100"];
+	n1 [label="[free]\n10"];
+	n0 -> n1;
+	n2 [label="a\n60"];
+	n3 [label="b\n40"];
+	n4 [label="c\n40"];
+	n3 -> n4;
+	n2 -> n3;
+	n5 [label="d\n15"];
+	n2 -> n5;
+	n0 -> n2;
+	n6 [label="e\n30"];
+	n0 -> n6;
+}
+`,
+		},
+		{
+			name: "single node",
+			root: &types.FlameGraphNode{Name: "leaf", Value: 1},
+			expected: `digraph flamegraph {
+	node [shape=box];
+	n0 [label="leaf\n1"];
+}
+`,
+		},
+		{
+			name: "escaped name",
+			root: &types.FlameGraphNode{Name: "say \"hi\"\r\n\\", Value: 2},
+			expected: `digraph flamegraph {
+	node [shape=box];
+	n0 [label="say \"hi\"\n\\\n2"];
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(renderDOT(tt.root)); got != tt.expected {
+				t.Errorf("unexpected DOT:\n got: %s\nwant: %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDotQuote(t *testing.T) {
+	tests := map[string]string{
+		"plain":          `"plain"`,
+		"":               `""`,
+		`a"b`:            `"a\"b"`,
+		`a\b`:            `"a\\b"`,
+		"a\nb":           `"a\nb"`,
+		"a\r\nb":         `"a\nb"`,
+		"юникод.метрика": `"юникод.метрика"`,
+	}
+	for in, expected := range tests {
+		if got := dotQuote(in); got != expected {
+			t.Errorf("dotQuote(%q): expected %v, got %v", in, expected, got)
+		}
+	}
+}
+
+func TestCountNodes(t *testing.T) {
+	if n := countNodes(testTree()); n != 7 {
+		t.Errorf("expected 7 nodes, got %v", n)
+	}
+	if n := countNodes(testTree().Children[1]); n != 4 {
+		t.Errorf("expected 4 nodes in the subtree, got %v", n)
+	}
+}
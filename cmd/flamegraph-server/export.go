@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func getTimestamps(req *http.Request, cluster string, from, until int64) ([]int64, error) {
+	rows, err := config.db.QueryContext(req.Context(), "SELECT DISTINCT timestamp FROM flamegraph_timestamps WHERE graph_type=? AND cluster=? AND timestamp >= ? AND timestamp <= ? ORDER BY timestamp", defaultGraphType, cluster, from, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []int64
+	for rows.Next() {
+		var ts int64
+		err = rows.Scan(&ts)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ts)
+	}
+	return res, rows.Err()
+}
+
+// Handler for the request /export?cluster=cluster&from=timestamp&until=timestamp&cursor=timestamp
+// Streams a tar with one <timestamp>.json per snapshot, in the same format /get returns. Only one snapshot is kept
+// in memory at a time. If the archive grows over MaxStreamBytes, its last entry is truncated.json with
+// a streamSummary, its cursor is the timestamp to continue from.
+func exportHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	ctx := req.Context()
+	logger := requestLogger(ctx, "export")
+
+	cluster := req.FormValue("cluster")
+	if cluster == "" {
+		logger.Error("You must specify cluster",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'cluster'", http.StatusBadRequest)
+		return
+	}
+	logger = logger.With(zap.String("cluster", cluster))
+
+	fromStr := req.FormValue("from")
+	if cursor := req.FormValue("cursor"); cursor != "" {
+		fromStr = cursor
+	}
+	from, until, err := parseTimeRange(fromStr, req.FormValue("until"), t0)
+	if err != nil {
+		logger.Error("Error parsing 'from', 'until' or 'cursor'",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'from', 'until' or 'cursor': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if shedIfOverloaded(w, logger, "export", t0) {
+		return
+	}
+
+	timestamps, err := getTimestamps(req, cluster, from, until)
+	if err != nil {
+		requestsFailed.Add(1)
+		logger.Error("Error fetching timestamps",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data", http.StatusInternalServerError)
+		return
+	}
+
+	removeLowest, minValue := trimmingFor(cluster)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+cluster+".tar\"")
+	tw := tar.NewWriter(w)
+	budget := &byteBudget{max: config.MaxStreamBytes}
+	for i, ts := range timestamps {
+		// Headers are already sent, so the only way to report an error is to cut the archive short
+		tree, err := getTree(ctx, &treeRequest{
+			cluster:      cluster,
+			ts:           ts,
+			maxLevel:     defaultMaxLevel,
+			column:       "value",
+			removeLowest: removeLowest,
+			minValue:     minValue,
+		})
+		if err == nil {
+			var b []byte
+			b, err = json.Marshal(tree)
+			if err == nil && !budget.take(int64(len(b)), int64(i)) {
+				err = writeExportSummary(tw, int64(i), ts)
+				if err == nil {
+					err = errStreamLimit
+				}
+			}
+			if err == nil {
+				err = tw.WriteHeader(&tar.Header{
+					Name:    strconv.FormatInt(ts, 10) + ".json",
+					Mode:    0644,
+					Size:    int64(len(b)),
+					ModTime: time.Unix(ts, 0),
+					PAXRecords: map[string]string{
+						formatVersionPAXKey: treeFormatVersionStr,
+					},
+				})
+			}
+			if err == nil {
+				_, err = tw.Write(b)
+			}
+		}
+		if err == errStreamLimit {
+			timestamps = timestamps[:i]
+			break
+		}
+		if err != nil {
+			if clientGone(ctx) {
+				logAbandoned(logger, t0, err)
+				return
+			}
+			requestsFailed.Add(1)
+			logger.Error("Error exporting snapshot",
+				zap.Int64("snapshot", ts),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Int("snapshots", len(timestamps)),
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
+
+func writeExportSummary(tw *tar.Writer, rows, cursor int64) error {
+	b, err := json.Marshal(streamSummary{
+		Truncated: true,
+		Rows:      rows,
+		Cursor:    strconv.FormatInt(cursor, 10),
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "truncated.json",
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
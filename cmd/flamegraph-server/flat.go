@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const formatFlat = "flat"
+
+type flatNode struct {
+	Name        string  `json:"name"`
+	Value       int64   `json:"value"`
+	Total       int64   `json:"total"`
+	Parent      int64   `json:"parent"`
+	ChildrenIds []int64 `json:"children_ids"`
+	Synthetic   bool    `json:"synthetic,omitempty"`
+}
+
+// flattenTree returns every node of the tree keyed by id. Root's parent is 0. Synthetic nodes don't have ids
+// in the database, so they get negative ones.
+func flattenTree(root *types.FlameGraphNode) map[int64]*flatNode {
+	res := make(map[int64]*flatNode)
+	syntheticID := int64(0)
+	var walk func(n *types.FlameGraphNode, parentID int64) int64
+	walk = func(n *types.FlameGraphNode, parentID int64) int64 {
+		id := n.Id
+		if n.Synthetic || id == 0 {
+			syntheticID--
+			id = syntheticID
+		}
+		f := &flatNode{
+			Name:        n.Name,
+			Value:       n.Value,
+			Total:       n.Total,
+			Parent:      parentID,
+			ChildrenIds: make([]int64, 0, len(n.Children)),
+			Synthetic:   n.Synthetic,
+		}
+		res[id] = f
+		for _, c := range n.Children {
+			f.ChildrenIds = append(f.ChildrenIds, walk(c, id))
+		}
+		return id
+	}
+	walk(root, 0)
+	return res
+}
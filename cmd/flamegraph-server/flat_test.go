@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+func TestFlattenTree(t *testing.T) {
+	const (
+		disk = types.RootElementId
+		free = types.RootElementId + 1
+	)
+	withSynthetic := func() *types.FlameGraphNode {
+		root := testTree()
+		a := root.Children[1]
+		for _, name := range []string{"[trimmed]", "[other]"} {
+			a.Children = append(a.Children, &types.FlameGraphNode{Name: name, Value: 1, Total: 100, Parent: a, Synthetic: true})
+		}
+		return root
+	}
+
+	tests := []struct {
+		name     string
+		root     func() *types.FlameGraphNode
+		expected map[int64]*flatNode
+	}{
+		{
+			name: "whole tree",
+			root: testTree,
+			expected: map[int64]*flatNode{
+				disk: {Name: "[disk]", Value: 100, Total: 100, Parent: 0, ChildrenIds: []int64{free, 3, 7}},
+				free: {Name: "[free]", Value: 10, Total: 100, Parent: disk, ChildrenIds: []int64{}},
+				3:    {Name: "a", Value: 60, Total: 100, Parent: disk, ChildrenIds: []int64{4, 6}},
+				4:    {Name: "b", Value: 40, Total: 100, Parent: 3, ChildrenIds: []int64{5}},
+				5:    {Name: "c", Value: 40, Total: 100, Parent: 4, ChildrenIds: []int64{}},
+				6:    {Name: "d", Value: 15, Total: 100, Parent: 3, ChildrenIds: []int64{}},
+				7:    {Name: "e", Value: 30, Total: 100, Parent: disk, ChildrenIds: []int64{}},
+			},
+		},
+		{
+			// Parent of the returned root is 0 even if it has one in the whole tree
+			name: "subtree",
+			root: func() *types.FlameGraphNode { return testTree().Children[1] },
+			expected: map[int64]*flatNode{
+				3: {Name: "a", Value: 60, Total: 100, Parent: 0, ChildrenIds: []int64{4, 6}},
+				4: {Name: "b", Value: 40, Total: 100, Parent: 3, ChildrenIds: []int64{5}},
+				5: {Name: "c", Value: 40, Total: 100, Parent: 4, ChildrenIds: []int64{}},
+				6: {Name: "d", Value: 15, Total: 100, Parent: 3, ChildrenIds: []int64{}},
+			},
+		},
+		{
+			name: "synthetic nodes get negative ids",
+			root: func() *types.FlameGraphNode { return withSynthetic().Children[1] },
+			expected: map[int64]*flatNode{
+				3:  {Name: "a", Value: 60, Total: 100, Parent: 0, ChildrenIds: []int64{4, 6, -1, -2}},
+				4:  {Name: "b", Value: 40, Total: 100, Parent: 3, ChildrenIds: []int64{5}},
+				5:  {Name: "c", Value: 40, Total: 100, Parent: 4, ChildrenIds: []int64{}},
+				6:  {Name: "d", Value: 15, Total: 100, Parent: 3, ChildrenIds: []int64{}},
+				-1: {Name: "[trimmed]", Value: 1, Total: 100, Parent: 3, ChildrenIds: []int64{}, Synthetic: true},
+				-2: {Name: "[other]", Value: 1, Total: 100, Parent: 3, ChildrenIds: []int64{}, Synthetic: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := flattenTree(tt.root())
+			if !reflect.DeepEqual(got, tt.expected) {
+				a, _ := json.Marshal(got)
+				b, _ := json.Marshal(tt.expected)
+				t.Errorf("unexpected flat tree:\n got: %s\nwant: %s", a, b)
+			}
+		})
+	}
+}
+
+// Leaves must have an empty list of children rather than null, clients iterate it without checks
+func TestFlattenTreeJSON(t *testing.T) {
+	b, err := json.Marshal(flattenTree(testTree()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	c, ok := got["5"]
+	if !ok {
+		t.Fatalf("expected node 5 keyed by its id, got %s", b)
+	}
+	if ids, ok := c["children_ids"].([]interface{}); !ok || len(ids) != 0 {
+		t.Errorf("expected empty children_ids of a leaf, got %v", c["children_ids"])
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "strconv"
+
+// treeFormatVersion is the version of trees the server returns (/get and everything built from its JSON). Bump it
+// when a field changes meaning or is removed, adding an optional field is not a breaking change. It's sent as
+// formatVersion of the returned tree, so it survives the body being saved without headers, in the
+// X-Flamegraph-Format-Version header, in a PAX record of every /export entry and in the cache file, whose trees
+// are dropped on load if they were written in another version.
+const treeFormatVersion = 1
+
+// formatVersionPAXKey is the PAX record with treeFormatVersion in /export archives
+const formatVersionPAXKey = "FLAMEGRAPH.format_version"
+
+var treeFormatVersionStr = strconv.Itoa(treeFormatVersion)
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// hasSnapshots is set once ClickHouse returned at least one snapshot, it never goes back
+var hasSnapshots int32
+
+// healthzHandler reports that the process is alive, it doesn't depend on ClickHouse
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether there is anything to serve: until collector stores the first snapshot /get would
+// only return empty responses
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&hasSnapshots) == 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		var count uint64
+		err := config.db.QueryRowContext(ctx, "select count() from flamegraph_timestamps").Scan(&count)
+		if err != nil {
+			logger.Warn("readiness check failed",
+				zap.Error(err),
+			)
+			http.Error(w, "clickhouse is not available", http.StatusServiceUnavailable)
+			return
+		}
+		if count == 0 {
+			http.Error(w, "no snapshots yet", http.StatusServiceUnavailable)
+			return
+		}
+		atomic.StoreInt32(&hasSnapshots, 1)
+	}
+	w.Write([]byte("ok\n"))
+}
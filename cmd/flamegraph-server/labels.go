@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+)
+
+// labelKey is the flamegraph_metadata key labels of snapshots are stored under
+const labelKey = "label"
+
+const maxLabelLength = 256
+
+// setLabel stores the label of the snapshot, empty label removes it. The latest label wins, version is in
+// nanoseconds so a label can be corrected right away.
+func setLabel(ctx context.Context, graphType, cluster string, ts int64, label string) error {
+	tx, stmt, err := helper.DBStartTransaction(config.db, "INSERT INTO flamegraph_metadata (graph_type, cluster, timestamp, key, value, date, version) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = stmt.ExecContext(ctx, graphType, cluster, ts, labelKey, label, now, uint64(now.UnixNano()))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getLabels returns labels of the snapshots that have one
+func getLabels(ctx context.Context, graphType, cluster string, timestamps []int64) (map[int64]string, error) {
+	if len(timestamps) == 0 {
+		return nil, nil
+	}
+	from, until := timestamps[0], timestamps[0]
+	wanted := make(map[int64]bool, len(timestamps))
+	for _, ts := range timestamps {
+		wanted[ts] = true
+		if ts < from {
+			from = ts
+		}
+		if ts > until {
+			until = ts
+		}
+	}
+
+	rows, err := config.db.QueryContext(ctx, "SELECT timestamp, argMax(value, version) FROM flamegraph_metadata WHERE graph_type=? AND cluster=? AND key=? AND timestamp >= ? AND timestamp <= ? GROUP BY timestamp", graphType, cluster, labelKey, from, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var labels map[int64]string
+	for rows.Next() {
+		var ts int64
+		var label string
+		err = rows.Scan(&ts, &label)
+		if err != nil {
+			return nil, err
+		}
+		if label == "" || !wanted[ts] {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[int64]string)
+		}
+		labels[ts] = label
+	}
+	return labels, rows.Err()
+}
+
+// Handler for the request POST /label?cluster=cluster&ts=timestamp&label=text&graph_type=type
+// Attaches a label to the snapshot, empty label removes it. Labels are returned by /timestamps.
+func labelHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	ctx := req.Context()
+	logger := requestLogger(ctx, "label")
+
+	if req.Method != http.MethodPost {
+		logger.Error("Only POST is allowed",
+			zap.String("method", req.Method),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusMethodNotAllowed),
+		)
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cluster := req.FormValue("cluster")
+	ts := req.FormValue("ts")
+	if cluster == "" || ts == "" {
+		logger.Error("You must specify cluster and ts",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		return
+	}
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+	label := req.FormValue("label")
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("timestamp", ts),
+		zap.String("graph_type", graphType),
+		zap.String("label", label),
+	)
+
+	if !knownGraphTypes[graphType] {
+		logger.Error("Unknown graph type",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'graph_type'", http.StatusBadRequest)
+		return
+	}
+	if !utf8.ValidString(label) || len(label) > maxLabelLength {
+		logger.Error("Invalid label",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "'label' must be valid UTF-8 of at most 256 bytes", http.StatusBadRequest)
+		return
+	}
+
+	tsInt, err := parseTime(ts, t0)
+	if err != nil {
+		logger.Error("Error parsing ts",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = setLabel(ctx, graphType, cluster, tsInt, label)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error storing label",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error storing label", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusNoContent),
+	)
+}
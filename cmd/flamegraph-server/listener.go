@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+)
+
+// server owns the listener that serves the API. Listen address can be changed on SIGHUP without dropping
+// requests that are in flight: new listener is started first and only then the old one is drained.
+type server struct {
+	sync.Mutex
+	handler http.Handler
+	addr    string
+	srv     *http.Server
+
+	lastReload time.Time
+	lastError  string
+}
+
+type serverStatus struct {
+	Listen     string    `json:"listen"`
+	LastReload time.Time `json:"last_reload,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	// ClickhouseLoad and RequestsShed are only set if LoadShedding is enabled
+	ClickhouseLoad *clickhouseLoad  `json:"clickhouse_load,omitempty"`
+	RequestsShed   map[string]int64 `json:"requests_shed,omitempty"`
+}
+
+func listen(addr string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// serve starts serving on the listener in background and returns http.Server that owns it
+func (s *server) serve(l net.Listener) *http.Server {
+	srv := &http.Server{
+		Handler: s.handler,
+	}
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("error serving requests",
+				zap.String("listen", l.Addr().String()),
+				zap.Error(err),
+			)
+		}
+	}()
+	return srv
+}
+
+// rebind switches to the new address. If new address can't be bound, old listener is kept
+func (s *server) rebind(addr string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastReload = time.Now()
+	if addr == s.addr {
+		s.lastError = ""
+		return
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		s.lastError = err.Error()
+		logger.Error("failed to bind new address, keep serving on the old one",
+			zap.String("old_listen", s.addr),
+			zap.String("listen", addr),
+			zap.Error(err),
+		)
+		return
+	}
+	old, oldAddr := s.srv, s.addr
+	s.srv, s.addr, s.lastError = s.serve(l), addr, ""
+	logger.Info("serving on the new address",
+		zap.String("listen", addr),
+	)
+
+	go func() {
+		t0 := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), config.ListenerDrainTimeout)
+		defer cancel()
+		err := old.Shutdown(ctx)
+		if err != nil {
+			// Deadline exceeded, drop whatever is left
+			old.Close()
+		}
+		logger.Info("old listener closed",
+			zap.String("listen", oldAddr),
+			zap.Duration("drain_time", time.Since(t0)),
+			zap.Error(err),
+		)
+	}()
+}
+
+func (s *server) status() serverStatus {
+	s.Lock()
+	defer s.Unlock()
+	res := serverStatus{
+		Listen:     s.addr,
+		LastReload: s.lastReload,
+		LastError:  s.lastError,
+	}
+	if config.LoadShedding.CheckInterval > 0 {
+		load := currentLoad()
+		res.ClickhouseLoad = &load
+		res.RequestsShed = shedCounts()
+	}
+	return res
+}
+
+// reloadOnSIGHUP rereads the config file on SIGHUP. Only Listen is applied, everything else requires a restart
+func (s *server) reloadOnSIGHUP(cfgPath string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		newConfig := struct {
+			Listen string
+		}{
+			Listen: s.status().Listen,
+		}
+
+		configRaw, err := ioutil.ReadFile(cfgPath)
+		if err == nil {
+			err = yaml.Unmarshal(configRaw, &newConfig)
+		}
+		// Environment still wins over the file, otherwise a reload would move a listener configured via env
+		helper.OverrideFromEnv(envPrefix, map[string]*string{"LISTEN": &newConfig.Listen})
+		if err != nil {
+			logger.Error("failed to reload config",
+				zap.Error(err),
+			)
+			s.Lock()
+			s.lastReload, s.lastError = time.Now(), err.Error()
+			s.Unlock()
+			continue
+		}
+
+		s.rebind(newConfig.Listen)
+	}
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT and then stops accepting requests, giving the ones in flight
+// up to timeout to finish
+func (s *server) waitForShutdown(timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	logger.Info("shutting down",
+		zap.String("signal", sig.String()),
+		zap.Duration("timeout", timeout),
+	)
+
+	s.Lock()
+	srv := s.srv
+	s.Unlock()
+
+	t0 := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		// Deadline exceeded, drop whatever is left
+		srv.Close()
+	}
+	logger.Info("requests drained",
+		zap.Duration("drain_time", time.Since(t0)),
+		zap.Error(err),
+	)
+}
+
+func (s *server) statusHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(s.status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 
@@ -9,7 +11,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"io/ioutil"
-	"net"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -22,14 +24,65 @@ import (
 	ecache "github.com/dgryski/go-expirecache"
 	"github.com/kshvakov/clickhouse"
 
-	"github.com/Civil/ch-flamegraphs/types"
 	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
 )
 
 var logger *zap.Logger
 
+// envPrefix is the prefix of environment variables that override the config file, e.x. FLAMEGRAPH_SERVER_LISTEN
+const envPrefix = "FLAMEGRAPH_SERVER_"
+
+// statusClientClosedRequest is the non-standard code (borrowed from nginx) that we log
+// when the client went away before we managed to send the response
+const statusClientClosedRequest = 499
+
+var requestsAbandoned = expvar.NewInt("requests_abandoned")
+var requestsFailed = expvar.NewInt("requests_failed")
+var handlerPanics = expvar.NewInt("handler_panics")
+var cappedNodes = expvar.NewInt("capped_nodes")
+
+// recoverPanic makes sure that panic in any handler won't crash the whole server. Client gets 500 with id of
+// the request, the same id is logged with the stack
+func recoverPanic(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				handlerPanics.Add(1)
+				id := helper.RequestID(r)
+				logger.Error("panic while serving request",
+					zap.String("uri", r.RequestURI),
+					zap.String("request_id", id),
+					zap.Any("panic", rec),
+					zap.Int("http_code", http.StatusInternalServerError),
+					zap.Stack("stack"),
+				)
+				w.Header().Set(helper.RequestIDHeader, id)
+				http.Error(w, "Internal server error, request id "+id, http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientGone returns true if request was cancelled by the client, in that case it's not a server error
+func clientGone(ctx context.Context) bool {
+	return ctx.Err() == context.Canceled
+}
+
+func logAbandoned(logger *zap.Logger, t0 time.Time, err error) {
+	requestsAbandoned.Add(1)
+	logger.Warn("client closed connection",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", statusClientClosedRequest),
+		zap.Error(err),
+	)
+}
+
 type expireCache struct {
 	ec *ecache.Cache
+	// index is only set if cache is persisted to CacheFile
+	index *cacheIndex
 }
 
 func (ec expireCache) get(k string) ([]byte, bool) {
@@ -44,24 +97,130 @@ func (ec expireCache) get(k string) ([]byte, bool) {
 
 func (ec expireCache) set(k string, v []byte, expire int32) {
 	ec.ec.Set(k, v, uint64(len(v)), expire)
+	ec.remember(k, expire)
 }
 
 var config = struct {
 	RemoveLowestPct     float64
+	Clusters            []types.Cluster
 	ClickhouseHost      string
 	Listen              string
+	LogLevel            string // debug, info, warn or error
 	CacheSize           uint64
 	CacheTimeoutSeconds int32
 	RerunInterval       time.Duration
 
-	queryCache expireCache
-	db         *sql.DB
+	MaxConcurrentQueries int
+	MaxBulkRequests      int
+
+	// IdentityHeader is a header set by authenticating proxy, client's IP is used if it's empty
+	IdentityHeader  string
+	AdminIdentities []string
+	// DailyRowBudgets limits amount of rows client can read from ClickHouse per day
+	DailyRowBudgets map[string]int64
+	QuotaMaxClients int
+	MaxRawRows      int
+
+	// ListenerDrainTimeout is how long requests on the old listener can take after Listen was changed on reload
+	ListenerDrainTimeout time.Duration
+	// ShutdownTimeout is how long requests in flight can take after SIGTERM or SIGINT
+	ShutdownTimeout time.Duration
+
+	// ResponseSampleRate is a fraction of /get responses that are written to ResponseSampleDir for debugging
+	ResponseSampleRate     float64
+	ResponseSampleDir      string
+	ResponseSampleMaxBytes int64
+
+	// CacheFile, if set, is where cached trees are saved every CacheFileInterval and on shutdown.
+	// File is loaded on startup unless it's older than CacheFileMaxAge
+	CacheFile         string
+	CacheFileInterval time.Duration
+	CacheFileMaxAge   time.Duration
+
+	// MaxStreamBytes limits size of streamed responses (ndjson, export), 0 means no limit
+	MaxStreamBytes int64
+
+	// MaxDotNodes is the largest tree /get renders with format=dot
+	MaxDotNodes int
+
+	// ClickhouseMaxIdleTime closes connections that weren't used for that long, before something in between
+	// kills them silently. Pool is pinged every ClickhousePingInterval so dead connections are noticed in background
+	ClickhouseMaxIdleTime  time.Duration
+	ClickhousePingInterval time.Duration
+
+	// Connection pool to ClickHouse is shared by all requests. ClickhouseMaxOpenConns should be above
+	// MaxConcurrentQueries, as /time and health checks don't wait for the query limiter.
+	ClickhouseMaxOpenConns    int
+	ClickhouseMaxIdleConns    int
+	ClickhouseConnMaxLifetime time.Duration
+
+	// MemoryLimitMB fails queries that would grow heap over it, instead of getting OOM-killed
+	MemoryLimitMB uint64
+	// MaxChildrenPerNode limits how many children of a node are read, nodes over it are marked as truncated.
+	// 0 means no limit
+	MaxChildrenPerNode int
+
+	// Retention is how long snapshots are kept in ClickHouse. Requests for older snapshots get snapshot_expired
+	// error, 0 means only snapshots that are already gone are expired
+	Retention time.Duration
+
+	// LoadShedding rejects expensive requests while ClickHouse is overloaded, cached requests are still served
+	LoadShedding loadSheddingConfig
+
+	queryCache   expireCache
+	queryLimiter limiter
+	quota        *quotaTracker
+	sampler      *responseSampler
+	db           *sql.DB
 }{
 	ClickhouseHost:      "tcp://127.0.0.1:9000?debug=false",
 	Listen:              "[::]:8088",
 	CacheSize:           0,
 	CacheTimeoutSeconds: 60,
 	RerunInterval:       10 * time.Minute,
+
+	MaxConcurrentQueries: 8,
+	MaxBulkRequests:      32,
+	QuotaMaxClients:      10000,
+	MaxRawRows:           10000,
+
+	ListenerDrainTimeout: time.Minute,
+	ShutdownTimeout:      25 * time.Second,
+
+	MaxDotNodes: 500,
+
+	MaxChildrenPerNode: 100000,
+
+	ResponseSampleDir:      "samples",
+	ResponseSampleMaxBytes: 100 * 1024 * 1024,
+
+	CacheFileInterval: 5 * time.Minute,
+	CacheFileMaxAge:   30 * time.Minute,
+
+	ClickhouseMaxIdleTime:  5 * time.Minute,
+	ClickhousePingInterval: 30 * time.Second,
+
+	ClickhouseMaxOpenConns:    16,
+	ClickhouseMaxIdleConns:    8,
+	ClickhouseConnMaxLifetime: time.Hour,
+}
+
+// trimmingFor returns default trimming settings for the cluster: either fraction of the total or an absolute value
+func trimmingFor(cluster string) (float64, int64) {
+	for i := range config.Clusters {
+		c := &config.Clusters[i]
+		if c.Name != cluster {
+			continue
+		}
+		if c.MinValue > 0 {
+			return 0, c.MinValue
+		}
+		if c.RemoveLowestPct > 0 {
+			return c.RemoveLowestPct / 100, 0
+		}
+		break
+	}
+	return config.RemoveLowestPct / 100, 0
 }
 
 func getClusters() ([]string, error) {
@@ -207,13 +366,15 @@ func timeHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := "select distinct timestamp from flamegraph_timestamps where cluster='" + cluster + "' order by timestamp"
+	query := "select distinct timestamp, graph_type from flamegraph_timestamps where cluster=? order by timestamp"
 	if last {
-		query = "select max(timestamp) from flamegraph_timestamps where cluster='" + cluster + "'"
+		query = "select max(timestamp), graph_type from flamegraph_timestamps where cluster=? group by graph_type"
 	}
 
 	var resp []int64
-	rows, err := config.db.Query(query)
+	// rollups are not real snapshots, so they are listed separately
+	rollups := make(map[string][]int64)
+	rows, err := config.db.Query(query, cluster)
 	if err != nil {
 		logger.Error("Error during database query",
 			zap.Duration("runtime", time.Since(t0)),
@@ -226,7 +387,8 @@ func timeHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	for rows.Next() {
 		var v int64
-		err = rows.Scan(&v)
+		var graphType string
+		err = rows.Scan(&v, &graphType)
 		if err != nil {
 			logger.Error("Error retreiving timestamps",
 				zap.Duration("runtime", time.Since(t0)),
@@ -237,6 +399,10 @@ func timeHandler(w http.ResponseWriter, req *http.Request) {
 				http.StatusInternalServerError)
 			return
 		}
+		if graphType != defaultGraphType {
+			rollups[graphType] = append(rollups[graphType], v)
+			continue
+		}
 		resp = append(resp, v)
 	}
 
@@ -244,10 +410,12 @@ func timeHandler(w http.ResponseWriter, req *http.Request) {
 		Cluster    string
 		Last       bool
 		Timestamps []int64
+		Rollups    map[string][]int64 `json:",omitempty"`
 	}{
 		Cluster:    cluster,
 		Last:       last,
 		Timestamps: resp,
+		Rollups:    rollups,
 	})
 	if err != nil {
 		logger.Error("Error marshaling data",
@@ -269,23 +437,91 @@ func timeHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 // Handler for the request /get?cluster=cluster&ts=timestamp
+// ts=latest or no ts at all means the most recent snapshot of the cluster. Relative and RFC3339 ts mean the most
+// recent snapshot taken at or before that time, unix seconds must match a snapshot exactly.
 func getHandler(w http.ResponseWriter, req *http.Request) {
 	var err error
 	t0 := time.Now()
-	logger := logger.With(zap.String("handler", "get"))
+	ctx := req.Context()
+	trace := traceFromContext(ctx)
+	logger := requestLogger(ctx, "get")
 	// TODO: Add validation
 	ts := req.FormValue("ts")
 	cluster := req.FormValue("cluster")
-	maxLevel := req.FormValue("level")
+	maxLevelStr := req.FormValue("level")
 	fetch := req.FormValue("fetch")
-	if ts == "" || cluster == "" {
-		logger.Error("You must specify cluster and ts",
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+	prefix := req.FormValue("prefix")
+	excludeSynthetic := req.FormValue("exclude_synthetic") == "true"
+	excludeIdsStr := req.FormValue("exclude_ids")
+	var excluded map[int64]bool
+	if excludeIdsStr != "" {
+		excluded, err = parseIds(excludeIdsStr)
+		if err != nil {
+			logger.Error("Error parsing 'exclude_ids' parameter",
+				zap.String("exclude_ids", excludeIdsStr),
+				zap.Error(err),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'exclude_ids': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	coverage := float64(0)
+	if coverageStr := req.FormValue("coverage"); coverageStr != "" {
+		coverage, err = strconv.ParseFloat(coverageStr, 64)
+		if err != nil || coverage <= 0 || coverage > 1 {
+			logger.Error("Error parsing 'coverage' parameter",
+				zap.String("coverage", coverageStr),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'coverage', must be in (0, 1]", http.StatusBadRequest)
+			return
+		}
+	}
+	format := req.FormValue("format")
+	if format == "" {
+		format = formatJSON
+	}
+	if !isKnownFormat(format) {
+		logger.Error("Unknown format",
+			zap.String("format", format),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'format', see /formats", http.StatusBadRequest)
+		return
+	}
+	if cluster == "" {
+		logger.Error("You must specify cluster",
 			zap.Duration("runtime", time.Since(t0)),
 			zap.Int("http_code", http.StatusBadRequest),
 		)
-		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		http.Error(w, "Error parsing 'cluster'", http.StatusBadRequest)
 		return
 	}
+	// Latest snapshot depends on graph_type, it's resolved once that is validated. Until then tsInt is its upper bound.
+	latest := ts == "" || ts == "latest"
+	tsInt := int64(math.MaxInt64)
+	if !latest {
+		tsInt, err = parseTime(ts, t0)
+		if err != nil {
+			logger.Error("Error parsing ts",
+				zap.Error(err),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		latest = !isUnixTime(ts)
+		ts = strconv.FormatInt(tsInt, 10)
+	}
 
 	column := "value"
 	switch fetch {
@@ -293,11 +529,18 @@ func getHandler(w http.ResponseWriter, req *http.Request) {
 		column = "mtime"
 	}
 
-	removeLowest := float64(0)
+	removeLowest, minValue := trimmingFor(cluster)
 	removeLowestStr := req.FormValue("removePct")
-	if removeLowestStr == "" {
-		removeLowest = config.RemoveLowestPct / 100
-	} else {
+	minValueStr := req.FormValue("minValue")
+	if removeLowestStr != "" && minValueStr != "" {
+		logger.Error("Only one of 'removePct' or 'minValue' can be specified",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Only one of 'removePct' or 'minValue' can be specified", http.StatusBadRequest)
+		return
+	}
+	if removeLowestStr != "" {
 		removeLowest, err = strconv.ParseFloat(removeLowestStr, 64)
 		if err != nil {
 			logger.Error("Error parsing 'remove' parameter",
@@ -309,27 +552,127 @@ func getHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		removeLowest = removeLowest / 100
+		minValue = 0
+	}
+	if minValueStr != "" {
+		minValue, err = strconv.ParseInt(minValueStr, 10, 64)
+		if err != nil || minValue < 0 {
+			logger.Error("Error parsing 'minValue' parameter",
+				zap.Error(err),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'minValue'", http.StatusBadRequest)
+			return
+		}
+		removeLowest = 0
 	}
 
-	if maxLevel == "" {
-		maxLevel = "12"
+	maxLevel := int64(defaultMaxLevel)
+	if maxLevelStr != "" {
+		maxLevel, err = strconv.ParseInt(maxLevelStr, 10, 64)
+		if err != nil || maxLevel <= 0 {
+			logger.Error("Error parsing 'level' parameter",
+				zap.String("level", maxLevelStr),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'level'", http.StatusBadRequest)
+			return
+		}
 	}
 
-	cacheKey := "get&" + ts + "&" + cluster
+	if !knownGraphTypes[graphType] {
+		logger.Error("Unknown graph type",
+			zap.String("graph_type", graphType),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'graph_type'", http.StatusBadRequest)
+		return
+	}
+
+	if latest {
+		tsInt, err = latestSnapshot(ctx, cluster, graphType, tsInt)
+		if err != nil {
+			if clientGone(ctx) {
+				logAbandoned(logger, t0, err)
+				return
+			}
+			requestsFailed.Add(1)
+			logger.Error("Error resolving latest snapshot",
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.Error(err),
+			)
+			http.Error(w, "Error fetching data",
+				http.StatusInternalServerError)
+			return
+		}
+		if tsInt == 0 {
+			logger.Error("No snapshots",
+				zap.String("cluster", cluster),
+				zap.String("until", ts),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusNotFound),
+			)
+			http.Error(w, "No snapshots for the cluster at or before 'ts'", http.StatusNotFound)
+			return
+		}
+		ts = strconv.FormatInt(tsInt, 10)
+	}
+	w.Header().Set("X-Snapshot-Ts", ts)
+
+	cacheKey := "get&" + ts + "&" + graphType + "&" + cluster + "&" + column + "&" + strconv.FormatInt(maxLevel, 10) + "&" + strconv.FormatFloat(removeLowest, 'g', -1, 64) + "&" + strconv.FormatInt(minValue, 10) + "&" + prefix + "&" + strconv.FormatBool(excludeSynthetic) + "&" + strconv.FormatFloat(coverage, 'g', -1, 64) + "&" + excludeIdsStr
 
 	logger = logger.With(
 		zap.String("cluster", cluster),
 		zap.String("timestamp", ts),
 	)
 
-	if response, ok := config.queryCache.get(cacheKey); ok {
+	// Checksum covers stored rows and not the reconstructed tree, so it can be checked before the cache.
+	// It's a scan of the whole snapshot, so like /verify it's only for admins.
+	if req.FormValue("verify") == "true" {
+		if !isAdmin(req) {
+			logger.Warn("access denied",
+				zap.String("identity", clientIdentity(req)),
+				zap.String("reason", "verify is only for admins"),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusForbidden),
+			)
+			http.Error(w, "Access denied: 'verify' is only for admins, use /verify", http.StatusForbidden)
+			return
+		}
+		res, err := verifySnapshot(ctx, cluster, graphType, tsInt)
+		if err != nil {
+			logger.Warn("failed to verify snapshot",
+				zap.Error(err),
+			)
+		} else {
+			trace.event("snapshot verified", zap.Int("rows", res.Rows))
+			if res.Match != nil && !*res.Match {
+				w.Header().Set("X-Flamegraph-Warning", "snapshot checksum mismatch, stored rows differ from what collector built")
+			}
+		}
+	}
+
+	// Only nested JSON is cached, other formats are built from the tree
+	if response, ok := config.queryCache.get(cacheKey); ok && format == formatJSON {
+		trace.event("cache hit", zap.String("cache_key", cacheKey))
+		trace.setHeader(w)
 		logger.Info("request served",
 			zap.Duration("runtime", time.Since(t0)),
 			zap.Int("http_code", http.StatusOK),
 		)
+		config.sampler.sample(req.Form, response)
 		w.Write(response)
 		return
 	}
+	trace.event("cache miss", zap.String("cache_key", cacheKey))
+
+	if trimmedTooLittle(removeLowest, minValue) && shedIfOverloaded(w, logger, "get_untrimmed", t0) {
+		return
+	}
 
 	if err := config.db.Ping(); err != nil {
 		if exception, ok := err.(*clickhouse.Exception); ok {
@@ -353,24 +696,37 @@ func getHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	tsInt, err := strconv.ParseInt(ts, 10, 64)
+	oldest, err := oldestAvailable(ctx, cluster, graphType)
 	if err != nil {
-		logger.Error("Error parsing ts",
+		logger.Warn("failed to get oldest available snapshot",
+			zap.Error(err),
+		)
+	} else if oldest > 0 && tsInt < oldest {
+		logger.Info("snapshot expired",
+			zap.Int64("oldest_timestamp", oldest),
 			zap.Duration("runtime", time.Since(t0)),
-			zap.Int("http_code", http.StatusBadRequest),
+			zap.Int("http_code", http.StatusGone),
 		)
-		http.Error(w, "Error fetching data",
-			http.StatusBadRequest)
+		writeExpired(w, cluster, tsInt, oldest)
 		return
 	}
-	t := time.Unix(tsInt, 0)
-	date := t.Format("2006-01-02")
-
-	where := " timestamp=" + ts + " AND cluster='" + cluster + "' AND date='" + date + "'" + "AND level<" + maxLevel
 
-	rows, err := config.db.Query("SELECT sum(total) FROM flamegraph WHERE" + where + " AND name = '[disk]' group by timestamp")
+	flameGraphTreeRoot, err := getTree(ctx, &treeRequest{
+		graphType:    graphType,
+		cluster:      cluster,
+		ts:           tsInt,
+		maxLevel:     maxLevel,
+		column:       column,
+		removeLowest: removeLowest,
+		minValue:     minValue,
+	})
 	if err != nil {
-		logger.Error("Error during database query",
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error fetching data",
 			zap.Duration("runtime", time.Since(t0)),
 			zap.Int("http_code", http.StatusInternalServerError),
 			zap.Error(err),
@@ -379,70 +735,108 @@ func getHandler(w http.ResponseWriter, req *http.Request) {
 			http.StatusInternalServerError)
 		return
 	}
-	total := uint64(0)
-	for rows.Next() {
-		err = rows.Scan(&total)
-		if err != nil {
-			logger.Error("Error getting total",
+
+	if excluded != nil {
+		excludeIds(flameGraphTreeRoot, excluded)
+	}
+
+	if coverage > 0 && coverage < 1 {
+		foldToCoverage(flameGraphTreeRoot, coverage)
+	}
+
+	if excludeSynthetic {
+		removeSynthetic(flameGraphTreeRoot)
+	}
+
+	if prefix != "" {
+		flameGraphTreeRoot = findByPrefix(flameGraphTreeRoot, prefix)
+		if flameGraphTreeRoot == nil {
+			logger.Error("Prefix not found",
+				zap.String("prefix", prefix),
 				zap.Duration("runtime", time.Since(t0)),
-				zap.Int("http_code", http.StatusInternalServerError),
-				zap.Error(err),
+				zap.Int("http_code", http.StatusNotFound),
 			)
-			http.Error(w, "Error fetching data",
-				http.StatusInternalServerError)
+			http.Error(w, "Prefix not found", http.StatusNotFound)
 			return
 		}
+		flameGraphTreeRoot.FormatVersion = treeFormatVersion
 	}
 
-	minValue := int64(float64(total) * removeLowest)
-	minValueQuery := strconv.FormatInt(minValue, 10)
-
-	rows, err = config.db.Query("SELECT timestamp, cluster, id, any(name), sum(total), sum(" + column + "), any(children_ids) FROM flamegraph WHERE" + where + " AND value > " + minValueQuery + " group by timestamp, cluster, id")
-	if err != nil {
-		logger.Error("Error during database query",
+	if format == formatNDJSON {
+		cursor := int64(0)
+		if cursorStr := req.FormValue("cursor"); cursorStr != "" {
+			cursor, err = strconv.ParseInt(cursorStr, 10, 64)
+			if err != nil || cursor < 0 {
+				logger.Error("Error parsing 'cursor' parameter",
+					zap.String("cursor", cursorStr),
+					zap.Duration("runtime", time.Since(t0)),
+					zap.Int("http_code", http.StatusBadRequest),
+				)
+				http.Error(w, "Error parsing 'cursor'", http.StatusBadRequest)
+				return
+			}
+		}
+		trace.setHeader(w)
+		err = writeNDJSON(w, req, flameGraphTreeRoot, cursor)
+		if err != nil {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		logger.Info("request served",
+			zap.String("format", format),
 			zap.Duration("runtime", time.Since(t0)),
-			zap.Int("http_code", http.StatusInternalServerError),
-			zap.Error(err),
+			zap.Int("http_code", http.StatusOK),
 		)
-		http.Error(w, "Error fetching data",
-			http.StatusInternalServerError)
 		return
 	}
 
-	data := make(map[int64]types.ClickhouseField)
-	for rows.Next() {
-		var res types.ClickhouseField
-		err := rows.Scan(&res.Timestamp, &res.Cluster, &res.Id, &res.Name, &res.Total, &res.Value, &res.ChildrenIds)
-		if err != nil {
-			logger.Error("Error getting data",
+	if format == formatDOT {
+		if nodes := countNodes(flameGraphTreeRoot); nodes > config.MaxDotNodes {
+			logger.Error("Tree is too large for DOT",
+				zap.Int("nodes", nodes),
+				zap.Int("max_dot_nodes", config.MaxDotNodes),
 				zap.Duration("runtime", time.Since(t0)),
-				zap.Int("http_code", http.StatusInternalServerError),
-				zap.Error(err),
+				zap.Int("http_code", http.StatusRequestEntityTooLarge),
 			)
-			http.Error(w, "Error fetching data",
-				http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Tree has %v nodes, DOT is limited to %v: narrow it with prefix, maxLevel or removePct", nodes, config.MaxDotNodes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		trace.setHeader(w)
+		_, err = w.Write(renderDOT(flameGraphTreeRoot))
+		if err != nil {
+			logAbandoned(logger, t0, err)
 			return
 		}
-		data[res.Id] = res
+		logger.Info("request served",
+			zap.String("format", format),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusOK),
+		)
+		return
 	}
 
-	flameGraphTreeRoot := &types.FlameGraphNode{
-		Id:          data[types.RootElementId].Id,
-		Cluster:     data[types.RootElementId].Cluster,
-		Name:        data[types.RootElementId].Name,
-		Value:       data[types.RootElementId].Value,
-		Total:       data[types.RootElementId].Total,
-		Parent:      nil,
-		ChildrenIds: data[types.RootElementId].ChildrenIds,
+	if format == formatCollapsed {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		trace.setHeader(w)
+		err = writeCollapsed(ctx, w, flameGraphTreeRoot)
+		if err != nil {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		logger.Info("request served",
+			zap.String("format", format),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusOK),
+		)
+		return
 	}
 
-	if column == "mtime" {
-		flameGraphTreeRoot.Total = data[types.RootElementId].Value
+	var response interface{} = flameGraphTreeRoot
+	if format == formatFlat {
+		response = flattenTree(flameGraphTreeRoot)
 	}
-
-	helper.ReconstructTree(data, flameGraphTreeRoot, minValue)
-
-	b, err := json.Marshal(flameGraphTreeRoot)
+	b, err := json.Marshal(response)
 	if err != nil {
 		logger.Error("Error marshaling data",
 			zap.Duration("runtime", time.Since(t0)),
@@ -454,8 +848,17 @@ func getHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	config.queryCache.set(cacheKey, b, config.CacheTimeoutSeconds)
-	w.Write(b)
+	if format == formatJSON {
+		config.queryCache.set(cacheKey, b, config.CacheTimeoutSeconds)
+	}
+	config.sampler.sample(req.Form, b)
+	trace.event("response marshaled", zap.Int("bytes", len(b)))
+	trace.setHeader(w)
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
 
 	logger.Info("request served",
 		zap.Duration("runtime", time.Since(t0)),
@@ -463,12 +866,32 @@ func getHandler(w http.ResponseWriter, req *http.Request) {
 	)
 }
 
+// keepClickhouseAlive pings ClickHouse periodically. Broken connections are dropped from the pool by the driver,
+// so it's a background ping and not a user's request that hits them.
+func keepClickhouseAlive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := config.db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn("background ping of clickhouse failed",
+				zap.Error(err),
+			)
+		}
+	}
+}
+
 func cors(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Snapshot-Ts, X-Flamegraph-Warning, X-Flamegraph-Format-Version")
+		w.Header().Set("X-Flamegraph-Format-Version", treeFormatVersionStr)
 		fn(w, r)
 	}
 }
@@ -481,12 +904,20 @@ func main() {
 		fmt.Printf("Error creating logger: %+v\n", err)
 		os.Exit(1)
 	}
+	debugConfig := zap.NewProductionConfig()
+	debugConfig.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	debugLogger, err = debugConfig.Build()
+	if err != nil {
+		fmt.Printf("Error creating logger: %+v\n", err)
+		os.Exit(1)
+	}
 
 	cfgPath := flag.String("config", "config.yaml", "path to the config file")
+	serveSample := flag.Bool("serve-sample", false, "serve a built-in sample tree without ClickHouse, for frontend development. Config file is optional")
 	flag.Parse()
 
 	configRaw, err := ioutil.ReadFile(*cfgPath)
-	if err != nil {
+	if err != nil && !(*serveSample && os.IsNotExist(err)) {
 		logger.Fatal("Error reading configfile 'config.yaml'",
 			zap.Error(err),
 		)
@@ -498,17 +929,57 @@ func main() {
 			zap.Error(err),
 		)
 	}
+	helper.OverrideFromEnv(envPrefix, map[string]*string{
+		"LISTEN":          &config.Listen,
+		"CLICKHOUSE_HOST": &config.ClickhouseHost,
+		"LOG_LEVEL":       &config.LogLevel,
+	})
 
-	config.queryCache = expireCache{ec: ecache.New(config.CacheSize)}
-	go config.queryCache.ec.ApproximateCleaner(10 * time.Second)
-
-	tcpAddr, err := net.ResolveTCPAddr("tcp", config.Listen)
+	logger, err = helper.NewLogger(config.LogLevel)
 	if err != nil {
-		logger.Fatal("error resolving address",
-			zap.Error(err),
+		fmt.Printf("Error creating logger: %+v\n", err)
+		os.Exit(1)
+	}
+
+	if *serveSample {
+		serveSampleTree(config.Listen)
+		return
+	}
+
+	for i := range config.Clusters {
+		if err := config.Clusters[i].Validate(); err != nil {
+			logger.Fatal("invalid cluster configuration",
+				zap.Error(err),
+			)
+		}
+	}
+
+	if config.MaxConcurrentQueries <= 0 {
+		logger.Fatal("MaxConcurrentQueries must be positive",
+			zap.Int("max_concurrent_queries", config.MaxConcurrentQueries),
 		)
 	}
-	tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+
+	config.queryCache = expireCache{ec: ecache.New(config.CacheSize)}
+	go config.queryCache.ec.ApproximateCleaner(10 * time.Second)
+	if config.CacheFile != "" {
+		config.queryCache.index = &cacheIndex{expires: make(map[string]time.Time)}
+		config.queryCache.load(config.CacheFile, config.CacheFileMaxAge)
+		go persistCache(config.CacheFile, config.CacheFileInterval)
+	}
+	config.queryLimiter = newLimiter(config.MaxConcurrentQueries)
+	config.quota = newQuotaTracker(config.QuotaMaxClients)
+	go config.quota.cleaner(10 * time.Minute)
+	if config.ResponseSampleRate > 0 {
+		config.sampler, err = newResponseSampler(config.ResponseSampleRate, config.ResponseSampleDir, config.ResponseSampleMaxBytes)
+		if err != nil {
+			logger.Fatal("error initializing response sampler",
+				zap.Error(err),
+			)
+		}
+	}
+
+	tcpListener, err := listen(config.Listen)
 	if err != nil {
 		logger.Fatal("error binding to address",
 			zap.Error(err),
@@ -532,22 +1003,67 @@ func main() {
 		}
 		logger.Fatal("error pinging clickhouse", zap.Error(err))
 	}
+	config.db.SetMaxOpenConns(config.ClickhouseMaxOpenConns)
+	config.db.SetMaxIdleConns(config.ClickhouseMaxIdleConns)
+	config.db.SetConnMaxLifetime(config.ClickhouseConnMaxLifetime)
+	config.db.SetConnMaxIdleTime(config.ClickhouseMaxIdleTime)
+	go keepClickhouseAlive(config.ClickhousePingInterval)
+	go keepSamplingClickhouseLoad(config.LoadShedding.CheckInterval)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/get", cors(getHandler))
-	mux.HandleFunc("/get/", cors(getHandler))
-	mux.HandleFunc("/time", cors(timeHandler))
-	mux.HandleFunc("/time/", cors(timeHandler))
-	mux.HandleFunc("/clusters", cors(clustersHandler))
-	mux.HandleFunc("/clusters/", cors(clustersHandler))
-
-	srv := &http.Server{
-		Handler: mux,
+	mux.HandleFunc("/get", cors(quota(debugTrace(getHandler))))
+	mux.HandleFunc("/get/", cors(quota(debugTrace(getHandler))))
+	mux.HandleFunc("/time", cors(quota(timeHandler)))
+	mux.HandleFunc("/time/", cors(quota(timeHandler)))
+	mux.HandleFunc("/timestamps", cors(quota(timestampsHandler)))
+	mux.HandleFunc("/timestamps/", cors(quota(timestampsHandler)))
+	mux.HandleFunc("/label", cors(adminOnly(labelHandler)))
+	mux.HandleFunc("/label/", cors(adminOnly(labelHandler)))
+	mux.HandleFunc("/clusters", cors(quota(clustersHandler)))
+	mux.HandleFunc("/clusters/", cors(quota(clustersHandler)))
+	mux.HandleFunc("/node", cors(quota(nodeHandler)))
+	mux.HandleFunc("/node/", cors(quota(nodeHandler)))
+	mux.HandleFunc("/summary", cors(quota(summaryHandler)))
+	mux.HandleFunc("/summary/", cors(quota(summaryHandler)))
+	mux.HandleFunc("/cardinality", cors(quota(cardinalityHandler)))
+	mux.HandleFunc("/cardinality/", cors(quota(cardinalityHandler)))
+	mux.HandleFunc("/diff", cors(quota(diffHandler)))
+	mux.HandleFunc("/diff/", cors(quota(diffHandler)))
+	mux.HandleFunc("/diffsummary", cors(quota(diffSummaryHandler)))
+	mux.HandleFunc("/diffsummary/", cors(quota(diffSummaryHandler)))
+	mux.HandleFunc("/bulk", cors(quota(bulkHandler)))
+	mux.HandleFunc("/bulk/", cors(quota(bulkHandler)))
+	mux.HandleFunc("/raw", cors(adminOnly(quota(rawHandler))))
+	mux.HandleFunc("/raw/", cors(adminOnly(quota(rawHandler))))
+	mux.HandleFunc("/export", cors(adminOnly(quota(exportHandler))))
+	mux.HandleFunc("/verify", cors(adminOnly(quota(verifyHandler))))
+	mux.HandleFunc("/verify/", cors(adminOnly(quota(verifyHandler))))
+	mux.HandleFunc("/export/", cors(adminOnly(quota(exportHandler))))
+	mux.HandleFunc("/formats", cors(formatsHandler))
+	mux.HandleFunc("/formats/", cors(formatsHandler))
+	mux.HandleFunc("/quota", cors(quotaHandler))
+	mux.HandleFunc("/quota/", cors(quotaHandler))
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	s := &server{
+		handler: recoverPanic(mux),
+		addr:    config.Listen,
 	}
+	mux.HandleFunc("/status", cors(s.statusHandler))
+	mux.HandleFunc("/status/", cors(s.statusHandler))
 
 	logger.Info("Started",
 		zap.Any("config", config),
 	)
 
-	srv.Serve(tcpListener)
+	s.srv = s.serve(tcpListener)
+	go s.reloadOnSIGHUP(*cfgPath)
+
+	s.waitForShutdown(config.ShutdownTimeout)
+	if config.CacheFile != "" {
+		saveCache(config.CacheFile)
+	}
+	logger.Sync()
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+type formatDescription struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Description string `json:"description"`
+}
+
+// knownFormats are values of the /get 'format' parameter
+var knownFormats = []formatDescription{
+	{
+		Name:        formatJSON,
+		ContentType: "application/json",
+		Description: "Default. Whole tree as a single nested document, children are in the 'children' field.",
+	},
+	{
+		Name:        formatNDJSON,
+		ContentType: "application/x-ndjson",
+		Description: "One JSON object per line per node in pre-order: id, parentId, name, path (dot separated, relative to the returned root), depth (0 for the root) and value. Streamed, gzip is used if client accepts it. If response exceeds the byte limit, the last line is {\"truncated\": true, \"rows\": N, \"cursor\": C}, repeat the request with cursor=C to get the rest.",
+	},
+	{
+		Name:        formatFlat,
+		ContentType: "application/json",
+		Description: "Single JSON object that maps node id to {name, value, total, parent, children_ids}. Root's parent is 0, synthetic nodes get negative ids.",
+	},
+	{
+		Name:        formatDOT,
+		ContentType: "text/vnd.graphviz",
+		Description: "Graphviz digraph with edges from parents to children, labels are name and value. Only for trees up to MaxDotNodes nodes after trimming and maxLevel, larger ones get 413.",
+	},
+	{
+		Name:        formatCollapsed,
+		ContentType: "text/plain",
+		Description: "Folded stacks for flamegraph.pl and speedscope: one 'root;a;b value' line per leaf with its value. Nodes which children were trimmed get a line with the value their children don't cover. ';' in names is replaced with '_'.",
+	},
+}
+
+func isKnownFormat(format string) bool {
+	for _, f := range knownFormats {
+		if f.Name == format {
+			return true
+		}
+	}
+	return false
+}
+
+type ndjsonNode struct {
+	Id       int64  `json:"id"`
+	ParentID int64  `json:"parentId"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Depth    int    `json:"depth"`
+	Value    int64  `json:"value"`
+}
+
+// writeNDJSON streams the tree node by node, so nothing but the tree itself is kept in memory. First cursor rows
+// are skipped. If the response grows over MaxStreamBytes, it ends with a streamSummary record. It stops as soon as
+// writing fails or the client goes away.
+func writeNDJSON(w http.ResponseWriter, req *http.Request, root *types.FlameGraphNode, cursor int64) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	var out io.Writer = w
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	buf := bufio.NewWriter(out)
+	budget := &byteBudget{max: config.MaxStreamBytes}
+	ctx := req.Context()
+
+	row, emitted := int64(0), int64(0)
+	var walk func(n *types.FlameGraphNode, parentID int64, path string, depth int) error
+	walk = func(n *types.FlameGraphNode, parentID int64, path string, depth int) error {
+		if row%streamCheckRows == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if row >= cursor {
+			b, err := json.Marshal(ndjsonNode{
+				Id:       n.Id,
+				ParentID: parentID,
+				Name:     n.Name,
+				Path:     path,
+				Depth:    depth,
+				Value:    n.Value,
+			})
+			if err != nil {
+				return err
+			}
+			if !budget.take(int64(len(b))+1, emitted) {
+				return errStreamLimit
+			}
+			buf.Write(b)
+			if err = buf.WriteByte('\n'); err != nil {
+				return err
+			}
+			emitted++
+		}
+		row++
+		for _, c := range n.Children {
+			childPath := c.Name
+			if path != "" {
+				childPath = path + "." + c.Name
+			}
+			if err := walk(c, n.Id, childPath, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(root, 0, "", 0)
+	if err == errStreamLimit {
+		b, _ := json.Marshal(streamSummary{
+			Truncated: true,
+			Rows:      emitted,
+			Cursor:    strconv.FormatInt(row, 10),
+		})
+		buf.Write(b)
+		buf.WriteByte('\n')
+	} else if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+func formatsHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(struct {
+		Formats []formatDescription `json:"formats"`
+		Time    string              `json:"time"`
+	}{
+		Formats: knownFormats,
+		Time:    timeSyntax,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
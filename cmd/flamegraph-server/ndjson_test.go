@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// testTree returns a small tree with nodes at different depths:
+//
+//	[disk] 100
+//	├── [free] 10
+//	├── a 60
+//	│   ├── b 40
+//	│   │   └── c 40
+//	│   └── d 15
+//	└── e 30
+func testTree() *types.FlameGraphNode {
+	node := func(id int64, name string, value int64, children ...*types.FlameGraphNode) *types.FlameGraphNode {
+		n := &types.FlameGraphNode{Id: id, Name: name, Value: value, Total: 100, Children: children}
+		for _, c := range children {
+			c.Parent = n
+			n.ChildrenIds = append(n.ChildrenIds, c.Id)
+		}
+		return n
+	}
+	return node(types.RootElementId, "[disk]", 100,
+		node(types.RootElementId+1, "[free]", 10),
+		node(3, "a", 60,
+			node(4, "b", 40,
+				node(5, "c", 40),
+			),
+			node(6, "d", 15),
+		),
+		node(7, "e", 30),
+	)
+}
+
+// wideTree returns a root with n leaves, large enough to take a while to stream
+func wideTree(n int) *types.FlameGraphNode {
+	root := &types.FlameGraphNode{Id: types.RootElementId, Name: "[disk]"}
+	for i := 0; i < n; i++ {
+		c := &types.FlameGraphNode{
+			Id:     types.RootElementId + 1 + int64(i),
+			Name:   "metric_with_a_reasonably_long_name_" + strconv.Itoa(i),
+			Value:  1,
+			Parent: root,
+		}
+		root.Value++
+		root.Children = append(root.Children, c)
+		root.ChildrenIds = append(root.ChildrenIds, c.Id)
+	}
+	return root
+}
+
+// brokenWriter accepts the first chunk and fails every write after it, like a connection closed by the client
+type brokenWriter struct {
+	header http.Header
+	writes int
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+func (w *brokenWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *brokenWriter) WriteHeader(int) {}
+
+func (w *brokenWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errBrokenPipe
+	}
+	return len(b), nil
+}
+
+// cancelingWriter cancels the request after the first chunk, like the server does once it notices the client is gone
+type cancelingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancelingWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestWriteNDJSONReportsWriteError(t *testing.T) {
+	config.MaxStreamBytes = 0
+	w := &brokenWriter{}
+	req := httptest.NewRequest("GET", "/get?format=ndjson", nil)
+
+	err := writeNDJSON(w, req, wideTree(100000), 0)
+	if err != errBrokenPipe {
+		t.Fatalf("expected %v, got %v", errBrokenPipe, err)
+	}
+	if w.writes != 2 {
+		t.Errorf("expected streaming to stop at the first failed write, got %v writes", w.writes)
+	}
+}
+
+func TestWriteNDJSONStopsOnCanceledContext(t *testing.T) {
+	config.MaxStreamBytes = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := cancelingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+	req := httptest.NewRequest("GET", "/get?format=ndjson", nil).WithContext(ctx)
+
+	err := writeNDJSON(w, req, wideTree(100000), 0)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	// The rows between two checks are buffered, and a flush can happen before a check notices the cancellation
+	if max := streamCheckRows * 200; w.Body.Len() > max {
+		t.Errorf("expected at most %v bytes to be written after the client went away, got %v", max, w.Body.Len())
+	}
+}
+
+func TestWriteNDJSONClientDisconnect(t *testing.T) {
+	config.MaxStreamBytes = 0
+	done := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		done <- writeNDJSON(w, req, wideTree(1000000), 0)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the body before reading it to the end closes the connection
+	resp.Body.Close()
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Fatal("expected streaming to fail after the client disconnected")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("streaming didn't stop within 10s after the client disconnected")
+	}
+}
+
+// comparableNode is what both nested JSON and NDJSON carry about a node
+type comparableNode struct {
+	Name     string            `json:"name"`
+	Value    int64             `json:"value"`
+	Children []*comparableNode `json:"children,omitempty"`
+}
+
+// readNDJSON returns the streamed nodes and the cursor of the streamSummary, if the stream was truncated
+func readNDJSON(t *testing.T, body io.Reader) ([]ndjsonNode, string) {
+	var nodes []ndjsonNode
+	cursor := ""
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var summary streamSummary
+		if json.Unmarshal(scanner.Bytes(), &summary) == nil && summary.Truncated {
+			cursor = summary.Cursor
+			continue
+		}
+		var n ndjsonNode
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		nodes = append(nodes, n)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return nodes, cursor
+}
+
+// fromNDJSON rebuilds the tree out of streamed nodes using their ids and parent ids
+func fromNDJSON(t *testing.T, nodes []ndjsonNode) *comparableNode {
+	byID := make(map[int64]*comparableNode)
+	var root *comparableNode
+	for _, n := range nodes {
+		c := &comparableNode{Name: n.Name, Value: n.Value}
+		byID[n.Id] = c
+		if n.ParentID == 0 {
+			root = c
+			continue
+		}
+		parent, ok := byID[n.ParentID]
+		if !ok {
+			t.Fatalf("node %v comes before its parent %v", n.Id, n.ParentID)
+		}
+		parent.Children = append(parent.Children, c)
+	}
+	return root
+}
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	nested, err := json.Marshal(testTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected comparableNode
+	if err = json.Unmarshal(nested, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		gzip           bool
+		maxStreamBytes int64
+	}{
+		{name: "plain"},
+		{name: "gzip", gzip: true},
+		// Every response holds a couple of rows, the tree is rebuilt out of all of them following cursors
+		{name: "resumed with cursor", maxStreamBytes: 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.MaxStreamBytes = tt.maxStreamBytes
+			defer func() { config.MaxStreamBytes = 0 }()
+
+			var nodes []ndjsonNode
+			cursor, responses := "0", 0
+			for cursor != "" {
+				responses++
+				if responses > 10 {
+					t.Fatal("stream doesn't end")
+				}
+				req := httptest.NewRequest("GET", "/get?format=ndjson&cursor="+cursor, nil)
+				if tt.gzip {
+					req.Header.Set("Accept-Encoding", "gzip")
+				}
+				w := httptest.NewRecorder()
+				c, _ := strconv.ParseInt(cursor, 10, 64)
+				if err := writeNDJSON(w, req, testTree(), c); err != nil {
+					t.Fatal(err)
+				}
+				if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+					t.Errorf("unexpected Content-Type %q", ct)
+				}
+
+				var body io.Reader = w.Body
+				if tt.gzip {
+					if w.Header().Get("Content-Encoding") != "gzip" {
+						t.Fatal("expected gzipped response")
+					}
+					gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = gz
+				}
+				var page []ndjsonNode
+				page, cursor = readNDJSON(t, body)
+				nodes = append(nodes, page...)
+			}
+			if tt.maxStreamBytes > 0 && responses < 2 {
+				t.Errorf("expected the stream to be split by MaxStreamBytes, got %v response", responses)
+			}
+
+			got := fromNDJSON(t, nodes)
+			if !reflect.DeepEqual(got, &expected) {
+				a, _ := json.Marshal(got)
+				t.Errorf("tree rebuilt from ndjson differs from nested json:\n got: %s\nwant: %s", a, nested)
+			}
+			for _, n := range nodes {
+				if n.Id == 5 && (n.Path != "a.b.c" || n.Depth != 3) {
+					t.Errorf("unexpected path %q and depth %v of c", n.Path, n.Depth)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// lazyNode is a node with its immediate children only, used by UIs that expand the graph on demand
+type lazyNode struct {
+	Id            int64       `json:"id"`
+	ParentID      int64       `json:"parentId"`
+	Name          string      `json:"name"`
+	Total         int64       `json:"total"`
+	Value         int64       `json:"value"`
+	ChildrenCount int         `json:"childrenCount"`
+	Children      []*lazyNode `json:"children,omitempty"`
+}
+
+// getNode returns node with its immediate children. Returns nil if there is no such node in the snapshot.
+func getNode(ctx context.Context, graphType, cluster string, ts, id int64) (*lazyNode, error) {
+	date := time.Unix(ts, 0).Format("2006-01-02")
+	rows, err := config.db.QueryContext(ctx, "SELECT id, any(parent_id), any(name), sum(total), sum(value), any("+helper.ChildrenIdsColumn+") FROM flamegraph WHERE graph_type=? AND timestamp=? AND cluster=? AND date=? AND (id=? OR parent_id=?) group by id", graphType, ts, cluster, date, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var node *lazyNode
+	var children []*lazyNode
+	for rows.Next() {
+		var res types.ClickhouseField
+		err = rows.Scan(&res.Id, &res.ParentID, &res.Name, &res.Total, &res.Value, &res.ChildrenIds)
+		if err != nil {
+			return nil, err
+		}
+		n := &lazyNode{
+			Id:            res.Id,
+			ParentID:      res.ParentID,
+			Name:          res.Name,
+			Total:         res.Total,
+			Value:         res.Value,
+			ChildrenCount: len(res.ChildrenIds),
+		}
+		if res.Id == id {
+			node = n
+		} else {
+			children = append(children, n)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	accountRows(ctx, int64(len(children)+1))
+
+	// If node is not found, it doesn't belong to this cluster and timestamp, children must be ignored as well
+	if node != nil {
+		node.Children = children
+	}
+	return node, nil
+}
+
+// Handler for the request /node?cluster=cluster&ts=timestamp&id=id&graph_type=type
+func nodeHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "node"))
+
+	cluster := req.FormValue("cluster")
+	ts := req.FormValue("ts")
+	idStr := req.FormValue("id")
+	if cluster == "" || ts == "" {
+		logger.Error("You must specify cluster and ts",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		return
+	}
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("timestamp", ts),
+		zap.String("id", idStr),
+		zap.String("graph_type", graphType),
+	)
+
+	if !knownGraphTypes[graphType] {
+		logger.Error("Unknown graph type",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'graph_type'", http.StatusBadRequest)
+		return
+	}
+
+	tsInt, err := parseTime(ts, t0)
+	if err != nil {
+		logger.Error("Error parsing ts",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := types.RootElementId
+	if idStr != "" {
+		id, err = strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			logger.Error("Error parsing id",
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'id'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := req.Context()
+	node, err := getNode(ctx, graphType, cluster, tsInt, id)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error fetching data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	if node == nil {
+		logger.Info("node not found",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusNotFound),
+		)
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(node)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
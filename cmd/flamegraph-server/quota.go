@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	quotaWindow = 24 * time.Hour
+	// quotaBucket is the granularity of the sliding window: usage expires one bucket at a time once it's older
+	// than quotaWindow, so a budget can't be spent twice around a reset
+	quotaBucket  = time.Hour
+	quotaBuckets = int(quotaWindow / quotaBucket)
+)
+
+type identityKeyType struct{}
+
+var identityKey identityKeyType
+
+// clientUsage is usage of a client within the last quotaWindow, counted since WindowStart
+type clientUsage struct {
+	Requests    int64
+	Rows        int64
+	Bytes       int64
+	Budget      int64 `json:",omitempty"`
+	WindowStart time.Time
+}
+
+type usageCounters struct {
+	requests int64
+	rows     int64
+	bytes    int64
+}
+
+// clientWindow keeps usage of a client per quotaBucket. Bucket number n (time since epoch divided by quotaBucket)
+// lives in slot n % quotaBuckets, a slot that holds an older bucket is stale and is reused.
+type clientWindow struct {
+	counters [quotaBuckets]usageCounters
+	buckets  [quotaBuckets]int64
+	budget   int64
+	lastSeen time.Time
+}
+
+func bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(quotaBucket)
+}
+
+func (c *clientWindow) add(now time.Time, requests, rows, bytes int64) {
+	bucket := bucketOf(now)
+	slot := bucket % int64(quotaBuckets)
+	if c.buckets[slot] != bucket {
+		c.buckets[slot] = bucket
+		c.counters[slot] = usageCounters{}
+	}
+	c.counters[slot].requests += requests
+	c.counters[slot].rows += rows
+	c.counters[slot].bytes += bytes
+	c.lastSeen = now
+}
+
+// usage sums buckets that are still within the window
+func (c *clientWindow) usage(now time.Time) clientUsage {
+	current := bucketOf(now)
+	oldest := current - int64(quotaBuckets) + 1
+	res := clientUsage{
+		Budget:      c.budget,
+		WindowStart: time.Unix(0, oldest*int64(quotaBucket)),
+	}
+	for i, bucket := range c.buckets {
+		if bucket < oldest || bucket > current {
+			continue
+		}
+		res.Requests += c.counters[i].requests
+		res.Rows += c.counters[i].rows
+		res.Bytes += c.counters[i].bytes
+	}
+	return res
+}
+
+// quotaTracker keeps per-client usage counters for a sliding quotaWindow. Amount of tracked clients is limited,
+// least recently seen clients are evicted first
+type quotaTracker struct {
+	sync.Mutex
+	clients    map[string]*clientWindow
+	maxClients int
+}
+
+func newQuotaTracker(maxClients int) *quotaTracker {
+	return &quotaTracker{
+		clients:    make(map[string]*clientWindow),
+		maxClients: maxClients,
+	}
+}
+
+// get returns usage window of the identity, creating it if needed. Must be called with lock held
+func (q *quotaTracker) get(identity string) *clientWindow {
+	c, ok := q.clients[identity]
+	if ok {
+		return c
+	}
+	if len(q.clients) >= q.maxClients {
+		q.evictOldest()
+	}
+	c = &clientWindow{
+		budget: config.DailyRowBudgets[identity],
+	}
+	q.clients[identity] = c
+	return c
+}
+
+func (q *quotaTracker) evictOldest() {
+	var oldest string
+	var oldestTime time.Time
+	for k, c := range q.clients {
+		if oldest == "" || c.lastSeen.Before(oldestTime) {
+			oldest = k
+			oldestTime = c.lastSeen
+		}
+	}
+	delete(q.clients, oldest)
+}
+
+// cleanup removes clients that weren't seen within the window, nothing of their usage counts anymore
+func (q *quotaTracker) cleanup(now time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	for k, c := range q.clients {
+		if now.Sub(c.lastSeen) >= quotaWindow {
+			delete(q.clients, k)
+		}
+	}
+}
+
+func (q *quotaTracker) cleaner(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		q.cleanup(time.Now())
+	}
+}
+
+// add accounts the request and returns false if the client is out of budget
+func (q *quotaTracker) add(identity string, now time.Time, requests, rows, bytes int64) bool {
+	q.Lock()
+	defer q.Unlock()
+	c := q.get(identity)
+	c.add(now, requests, rows, bytes)
+	return c.budget == 0 || c.usage(now).Rows < c.budget
+}
+
+func (q *quotaTracker) usage(identity string, now time.Time) clientUsage {
+	q.Lock()
+	defer q.Unlock()
+	if c, ok := q.clients[identity]; ok {
+		return c.usage(now)
+	}
+	return (&clientWindow{budget: config.DailyRowBudgets[identity]}).usage(now)
+}
+
+func (q *quotaTracker) all(now time.Time) map[string]clientUsage {
+	q.Lock()
+	defer q.Unlock()
+	res := make(map[string]clientUsage, len(q.clients))
+	for k, c := range q.clients {
+		res[k] = c.usage(now)
+	}
+	return res
+}
+
+// clientIdentity returns identity of the client, either from IdentityHeader (set by authenticating proxy) or client's IP
+func clientIdentity(req *http.Request) string {
+	if config.IdentityHeader != "" {
+		if id := req.Header.Get(config.IdentityHeader); id != "" {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func isAdmin(req *http.Request) bool {
+	identity := clientIdentity(req)
+	for _, admin := range config.AdminIdentities {
+		if admin == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly rejects requests from anyone who is not listed in AdminIdentities
+func adminOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			logger.Warn("access denied",
+				zap.String("identity", clientIdentity(r)),
+				zap.String("uri", r.RequestURI),
+				zap.Int("http_code", http.StatusForbidden),
+			)
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func identityFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey).(string)
+	return id
+}
+
+// accountRows adds amount of rows read from ClickHouse to the client's usage
+func accountRows(ctx context.Context, rows int64) {
+	if id := identityFromContext(ctx); id != "" {
+		config.quota.add(id, time.Now(), 0, rows, 0)
+	}
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(&w.bytes, int64(n))
+	return n, err
+}
+
+// quota accounts requests and returned bytes per client and rejects requests from clients that exhausted their budget
+func quota(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := clientIdentity(r)
+		if !config.quota.add(identity, time.Now(), 1, 0, 0) {
+			logger.Warn("client is out of budget",
+				zap.String("identity", identity),
+				zap.String("uri", r.RequestURI),
+				zap.Int("http_code", http.StatusTooManyRequests),
+			)
+			http.Error(w, "Daily budget exhausted", http.StatusTooManyRequests)
+			return
+		}
+
+		cw := &countingResponseWriter{ResponseWriter: w}
+		fn(cw, r.WithContext(context.WithValue(r.Context(), identityKey, identity)))
+		config.quota.add(identity, time.Now(), 0, 0, atomic.LoadInt64(&cw.bytes))
+	}
+}
+
+// Handler for the request /quota. Admins can see usage of all clients, others only their own.
+func quotaHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	identity := clientIdentity(req)
+	logger := logger.With(
+		zap.String("handler", "quota"),
+		zap.String("identity", identity),
+	)
+
+	var resp interface{}
+	if isAdmin(req) {
+		resp = config.quota.all(t0)
+	} else {
+		resp = map[string]clientUsage{identity: config.quota.usage(identity, t0)}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error marshaling data",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
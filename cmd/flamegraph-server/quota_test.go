@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaBudget(t *testing.T) {
+	config.DailyRowBudgets = map[string]int64{"limited": 100}
+	defer func() { config.DailyRowBudgets = nil }()
+	t0 := time.Date(2021, 3, 28, 10, 30, 0, 0, time.UTC)
+
+	type step struct {
+		after   time.Duration
+		rows    int64
+		allowed bool
+		used    int64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "within budget",
+			steps: []step{
+				{after: 0, rows: 40, allowed: true, used: 40},
+				{after: time.Hour, rows: 59, allowed: true, used: 99},
+			},
+		},
+		{
+			name: "exhausted",
+			steps: []step{
+				{after: 0, rows: 60, allowed: true, used: 60},
+				{after: time.Minute, rows: 40, allowed: false, used: 100},
+				{after: 2 * time.Minute, rows: 0, allowed: false, used: 100},
+			},
+		},
+		{
+			// A fixed window would reset right after 23:59 and let the client spend the budget twice
+			name: "no reset around the window boundary",
+			steps: []step{
+				{after: 0, rows: 10, allowed: true, used: 10},
+				{after: 23 * time.Hour, rows: 90, allowed: false, used: 100},
+				{after: 24*time.Hour + 30*time.Minute, rows: 0, allowed: true, used: 90},
+				{after: 24*time.Hour + 31*time.Minute, rows: 50, allowed: false, used: 140},
+			},
+		},
+		{
+			name: "usage slides out of the window bucket by bucket",
+			steps: []step{
+				{after: 0, rows: 60, allowed: true, used: 60},
+				{after: 12 * time.Hour, rows: 40, allowed: false, used: 100},
+				{after: 24 * time.Hour, rows: 0, allowed: true, used: 40},
+				{after: 36 * time.Hour, rows: 0, allowed: true, used: 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuotaTracker(10)
+			for i, s := range tt.steps {
+				now := t0.Add(s.after)
+				if allowed := q.add("limited", now, 1, s.rows, 0); allowed != s.allowed {
+					t.Errorf("step %v: expected allowed=%v, got %v", i, s.allowed, allowed)
+				}
+				if used := q.usage("limited", now).Rows; used != s.used {
+					t.Errorf("step %v: expected %v rows used, got %v", i, s.used, used)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaWithoutBudget(t *testing.T) {
+	q := newQuotaTracker(10)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !q.add("unlimited", now, 1, 1000000, 10) {
+			t.Fatal("client without budget must never run out of it")
+		}
+	}
+	u := q.usage("unlimited", now)
+	if u.Requests != 3 || u.Rows != 3000000 || u.Bytes != 30 || u.Budget != 0 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+}
+
+func TestQuotaEviction(t *testing.T) {
+	t0 := time.Date(2021, 3, 28, 10, 0, 0, 0, time.UTC)
+	q := newQuotaTracker(2)
+	q.add("a", t0, 1, 0, 0)
+	q.add("b", t0.Add(time.Minute), 1, 0, 0)
+	// a was seen after b, so b is the least recently seen client
+	q.add("a", t0.Add(2*time.Minute), 1, 0, 0)
+	q.add("c", t0.Add(3*time.Minute), 1, 0, 0)
+
+	all := q.all(t0.Add(3 * time.Minute))
+	if len(all) != 2 {
+		t.Fatalf("expected 2 tracked clients, got %v", len(all))
+	}
+	if _, ok := all["b"]; ok {
+		t.Error("expected b to be evicted")
+	}
+	if all["a"].Requests != 2 || all["c"].Requests != 1 {
+		t.Errorf("unexpected usage %+v", all)
+	}
+}
+
+func TestQuotaCleanup(t *testing.T) {
+	t0 := time.Date(2021, 3, 28, 10, 0, 0, 0, time.UTC)
+	q := newQuotaTracker(10)
+	q.add("old", t0, 1, 0, 0)
+	q.add("recent", t0.Add(20*time.Hour), 1, 0, 0)
+
+	q.cleanup(t0.Add(24 * time.Hour))
+	all := q.all(t0.Add(24 * time.Hour))
+	if _, ok := all["old"]; ok {
+		t.Error("expected client not seen within the window to be removed")
+	}
+	if _, ok := all["recent"]; !ok {
+		t.Error("expected client seen within the window to be kept")
+	}
+}
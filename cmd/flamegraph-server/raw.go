@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// Handler for the request /raw?cluster=cluster&ts=timestamp&limit=rows&graph_type=type
+// Returns rows exactly as they are stored, without reconstructing the tree. Useful to debug reconstruction.
+func rawHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "raw"))
+
+	cluster := req.FormValue("cluster")
+	ts := req.FormValue("ts")
+	if cluster == "" || ts == "" {
+		logger.Error("You must specify cluster and ts",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		return
+	}
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("timestamp", ts),
+		zap.String("graph_type", graphType),
+	)
+
+	if !knownGraphTypes[graphType] {
+		logger.Error("Unknown graph type",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'graph_type'", http.StatusBadRequest)
+		return
+	}
+
+	tsInt, err := parseTime(ts, t0)
+	if err != nil {
+		logger.Error("Error parsing ts",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := config.MaxRawRows
+	if limitStr := req.FormValue("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > config.MaxRawRows {
+			logger.Error("Error parsing limit",
+				zap.String("limit", limitStr),
+				zap.Int("max_raw_rows", config.MaxRawRows),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'limit'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := req.Context()
+	date := time.Unix(tsInt, 0).Format("2006-01-02")
+	rows, err := config.db.QueryContext(ctx, "SELECT timestamp, graph_type, cluster, name, total, id, value, mtime, level, parent_id, "+helper.ChildrenIdsColumn+" FROM flamegraph WHERE graph_type=? AND timestamp=? AND cluster=? AND date=? ORDER BY level, id LIMIT ?", graphType, tsInt, cluster, date, limit)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error during database query",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var resp []types.ClickhouseField
+	for rows.Next() {
+		var res types.ClickhouseField
+		err = rows.Scan(&res.Timestamp, &res.GraphType, &res.Cluster, &res.Name, &res.Total, &res.Id, &res.Value, &res.ModTime, &res.Level, &res.ParentID, &res.ChildrenIds)
+		if err != nil {
+			logger.Error("Error getting data",
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.Error(err),
+			)
+			http.Error(w, "Error fetching data",
+				http.StatusInternalServerError)
+			return
+		}
+		resp = append(resp, res)
+	}
+	accountRows(ctx, int64(len(resp)))
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Int("rows", len(resp)),
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errSnapshotExpired is the error code of requests for snapshots that were already removed by retention
+const errSnapshotExpired = "snapshot_expired"
+
+// oldestAvailable returns timestamp of the oldest snapshot of the cluster that is still within Retention, 0 if
+// there are none. Snapshots can outlive Retention until ClickHouse drops their partitions, those are treated as
+// expired already, as they may disappear at any moment.
+func oldestAvailable(ctx context.Context, cluster, graphType string) (int64, error) {
+	cacheKey := "oldest&" + cluster + "&" + graphType
+	if response, ok := config.queryCache.get(cacheKey); ok {
+		return strconv.ParseInt(string(response), 10, 64)
+	}
+
+	since := int64(0)
+	if config.Retention > 0 {
+		since = time.Now().Add(-config.Retention).Unix()
+	}
+	var oldest int64
+	err := config.db.QueryRowContext(ctx, "SELECT min(timestamp) FROM flamegraph_timestamps WHERE cluster=? AND graph_type=? AND timestamp >= ?", cluster, graphType, since).Scan(&oldest)
+	if err != nil {
+		return 0, err
+	}
+	config.queryCache.set(cacheKey, []byte(strconv.FormatInt(oldest, 10)), int32(config.RerunInterval.Seconds()))
+	return oldest, nil
+}
+
+// writeExpired responds to a request for a snapshot that is older than the oldest available one
+func writeExpired(w http.ResponseWriter, cluster string, ts, oldest int64) {
+	b, _ := json.Marshal(struct {
+		Error           string `json:"error"`
+		Cluster         string `json:"cluster"`
+		Timestamp       int64  `json:"timestamp"`
+		OldestTimestamp int64  `json:"oldest_timestamp"`
+		Hint            string `json:"hint"`
+	}{
+		Error:           errSnapshotExpired,
+		Cluster:         cluster,
+		Timestamp:       ts,
+		OldestTimestamp: oldest,
+		Hint:            "snapshot was removed by retention, see /timestamps?cluster=" + cluster + " for available ones",
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	w.Write(b)
+}
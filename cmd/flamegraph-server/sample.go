@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// responseSampler writes a fraction of /get responses to disk. Oldest samples are removed once the directory
+// grows over the limit.
+type responseSampler struct {
+	sync.Mutex
+	rate     float64
+	dir      string
+	maxBytes int64
+
+	files []sampleFile
+	size  int64
+}
+
+type sampleFile struct {
+	name string
+	size int64
+}
+
+type responseSample struct {
+	Time     time.Time       `json:"time"`
+	Params   url.Values      `json:"params"`
+	Response json.RawMessage `json:"response"`
+}
+
+func newResponseSampler(rate float64, dir string, maxBytes int64) (*responseSampler, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &responseSampler{
+		rate:     rate,
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+
+	// Samples from the previous runs count towards the limit as well
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		s.files = append(s.files, sampleFile{name: fi.Name(), size: fi.Size()})
+		s.size += fi.Size()
+	}
+	// File names start with a timestamp, so it's also the order they were written in
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].name < s.files[j].name
+	})
+	return s, nil
+}
+
+// sample decides if response should be sampled and, if so, writes it in background
+func (s *responseSampler) sample(params url.Values, response []byte) {
+	if s == nil || rand.Float64() >= s.rate {
+		return
+	}
+	go s.write(params, response)
+}
+
+func (s *responseSampler) write(params url.Values, response []byte) {
+	now := time.Now()
+	b, err := json.Marshal(responseSample{
+		Time:     now,
+		Params:   params,
+		Response: response,
+	})
+	if err != nil {
+		logger.Error("failed to marshal response sample",
+			zap.Error(err),
+		)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for len(s.files) > 0 && s.size+int64(len(b)) > s.maxBytes {
+		err = os.Remove(filepath.Join(s.dir, s.files[0].name))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("failed to remove old response sample",
+				zap.String("file", s.files[0].name),
+				zap.Error(err),
+			)
+			return
+		}
+		s.size -= s.files[0].size
+		s.files = s.files[1:]
+	}
+	if s.size+int64(len(b)) > s.maxBytes {
+		// Sample alone is larger than the limit
+		return
+	}
+
+	name := strconv.FormatInt(now.UnixNano(), 10) + ".json"
+	err = ioutil.WriteFile(filepath.Join(s.dir, name), b, 0644)
+	if err != nil {
+		logger.Error("failed to write response sample",
+			zap.Error(err),
+		)
+		return
+	}
+	s.files = append(s.files, sampleFile{name: name, size: int64(len(b))})
+	s.size += int64(len(b))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const (
+	sampleCluster     = "sample"
+	sampleMetricBytes = 1728 * 1024
+	sampleTotalBytes  = 4 * 1024 * 1024 * 1024
+)
+
+// sampleTree builds a small tree that looks like a real graphite_metrics snapshot: '[free]' next to a few
+// top-level prefixes of different sizes and depths. It's built from constants only, so every call returns the same tree.
+func sampleTree() *types.FlameGraphNode {
+	root := &types.FlameGraphNode{
+		Cluster: sampleCluster,
+		Name:    "[disk]",
+		Total:   sampleTotalBytes,
+	}
+
+	var used int64
+	add := func(path string, size int64) {
+		node := root
+		node.Value += size
+		for _, name := range strings.Split(path, ".") {
+			var child *types.FlameGraphNode
+			for _, c := range node.Children {
+				if c.Name == name {
+					child = c
+					break
+				}
+			}
+			if child == nil {
+				child = &types.FlameGraphNode{
+					Cluster: sampleCluster,
+					Name:    name,
+					Total:   sampleTotalBytes,
+					Parent:  node,
+				}
+				node.Children = append(node.Children, child)
+			}
+			child.Value += size
+			node = child
+		}
+		node.Count = 1
+		used += size
+	}
+
+	for i := 1; i <= 3; i++ {
+		for _, m := range []string{"cache.size", "cache.queries", "committedPoints", "cpuUsage", "memUsage"} {
+			add(fmt.Sprintf("carbon.agents.graphite%02d.%s", i, m), sampleMetricBytes)
+		}
+	}
+	for i := 1; i <= 8; i++ {
+		for _, m := range []string{"cpu.user", "cpu.system", "cpu.iowait", "memory.used", "memory.free", "disk.sda.reads", "disk.sda.writes"} {
+			add(fmt.Sprintf("servers.web%02d.%s", i, m), sampleMetricBytes)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		for _, m := range []string{"requests.count", "requests.errors", "latency.p50", "latency.p99"} {
+			add(fmt.Sprintf("apps.api.region%d.%s", i, m), sampleMetricBytes)
+		}
+	}
+	add("stats.timers.deploy.duration.mean", 4*sampleMetricBytes)
+
+	root.Children = append([]*types.FlameGraphNode{{
+		Cluster: sampleCluster,
+		Name:    "[free]",
+		Total:   sampleTotalBytes,
+		Value:   sampleTotalBytes - used,
+		Parent:  root,
+	}}, root.Children...)
+	root.Value = sampleTotalBytes
+	return root
+}
+
+// sampleTreeHandler serves sampleTree no matter what parameters are passed, so frontend can be developed without
+// collector and ClickHouse
+func sampleTreeHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(sampleTree())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// serveSampleTree is the '-serve-sample' mode: only the sample tree is served and ClickHouse is never contacted
+func serveSampleTree(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", cors(sampleTreeHandler))
+	mux.HandleFunc("/get/", cors(sampleTreeHandler))
+	mux.HandleFunc("/sample", cors(sampleTreeHandler))
+	mux.HandleFunc("/sample/", cors(sampleTreeHandler))
+	mux.HandleFunc("/healthz", healthzHandler)
+
+	logger.Info("Serving sample tree",
+		zap.String("listen", addr),
+	)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           recoverPanic(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	err := srv.ListenAndServe()
+	if err != nil {
+		logger.Fatal("error serving sample tree",
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var requestsShed = expvar.NewMap("requests_shed")
+
+type loadSheddingConfig struct {
+	// CheckInterval is how often load of ClickHouse is sampled, 0 disables shedding
+	CheckInterval time.Duration
+	// MaxRunningQueries and MaxActiveMerges are thresholds for queries running on the ClickHouse server and merges
+	// in progress. Either one exceeded makes ClickHouse overloaded, 0 disables the threshold
+	MaxRunningQueries int64
+	MaxActiveMerges   int64
+	// MinRemoveLowestPct is the lightest trimming, in percents, /get can ask for while ClickHouse is overloaded.
+	// Requests trimming less (and not trimming by minValue) are rejected unless they are cached
+	MinRemoveLowestPct float64
+}
+
+// trimmedTooLittle reports whether a tree trimmed by removeLowest (a fraction of total) or minValue is too
+// expensive to build while ClickHouse is overloaded
+func trimmedTooLittle(removeLowest float64, minValue int64) bool {
+	return minValue == 0 && removeLowest*100 < config.LoadShedding.MinRemoveLowestPct
+}
+
+// clickhouseLoad is the last sampled load of ClickHouse
+type clickhouseLoad struct {
+	Overloaded     bool      `json:"overloaded"`
+	RunningQueries int64     `json:"running_queries"`
+	ActiveMerges   int64     `json:"active_merges"`
+	CheckedAt      time.Time `json:"checked_at,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+var loadState = struct {
+	sync.Mutex
+	clickhouseLoad
+}{}
+
+func currentLoad() clickhouseLoad {
+	loadState.Lock()
+	defer loadState.Unlock()
+	return loadState.clickhouseLoad
+}
+
+func sampleClickhouseLoad(ctx context.Context) (clickhouseLoad, error) {
+	var res clickhouseLoad
+	err := config.db.QueryRowContext(ctx, "SELECT (SELECT toInt64(value) FROM system.metrics WHERE metric='Query'), (SELECT count() FROM system.merges)").Scan(&res.RunningQueries, &res.ActiveMerges)
+	if err != nil {
+		return res, err
+	}
+	cfg := config.LoadShedding
+	res.Overloaded = (cfg.MaxRunningQueries > 0 && res.RunningQueries > cfg.MaxRunningQueries) ||
+		(cfg.MaxActiveMerges > 0 && res.ActiveMerges > cfg.MaxActiveMerges)
+	return res, nil
+}
+
+// keepSamplingClickhouseLoad updates loadState every CheckInterval. If sampling fails, previous state is kept:
+// a failing query says nothing about load and /get will report ClickHouse errors on its own.
+func keepSamplingClickhouseLoad(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		load, err := sampleClickhouseLoad(ctx)
+		cancel()
+
+		loadState.Lock()
+		wasOverloaded := loadState.Overloaded
+		if err != nil {
+			loadState.LastError = err.Error()
+		} else {
+			load.CheckedAt = time.Now()
+			loadState.clickhouseLoad = load
+		}
+		state := loadState.clickhouseLoad
+		loadState.Unlock()
+
+		if err != nil {
+			logger.Warn("failed to sample clickhouse load",
+				zap.Error(err),
+			)
+			continue
+		}
+		if state.Overloaded != wasOverloaded {
+			logger.Warn("clickhouse load state changed",
+				zap.Bool("overloaded", state.Overloaded),
+				zap.Int64("running_queries", state.RunningQueries),
+				zap.Int64("active_merges", state.ActiveMerges),
+			)
+		}
+	}
+}
+
+func overloaded() bool {
+	return config.LoadShedding.CheckInterval > 0 && currentLoad().Overloaded
+}
+
+// shedIfOverloaded rejects the request with 503 if ClickHouse is overloaded. It returns true if the request was rejected.
+func shedIfOverloaded(w http.ResponseWriter, logger *zap.Logger, class string, t0 time.Time) bool {
+	if !overloaded() {
+		return false
+	}
+	requestsShed.Add(class, 1)
+	logger.Warn("ClickHouse is overloaded, request rejected",
+		zap.String("class", class),
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusServiceUnavailable),
+	)
+	w.Header().Set("Retry-After", strconv.Itoa(int(config.LoadShedding.CheckInterval.Seconds()+0.5)))
+	http.Error(w, "ClickHouse is overloaded, try again later or request a trimmed graph", http.StatusServiceUnavailable)
+	return true
+}
+
+func shedCounts() map[string]int64 {
+	res := make(map[string]int64)
+	requestsShed.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			res[kv.Key] = v.Value()
+		}
+	})
+	return res
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+)
+
+// errStreamLimit stops streaming once MaxStreamBytes is reached
+var errStreamLimit = errors.New("stream byte limit reached")
+
+// streamCheckRows is how often streaming checks whether the client is still there. Write errors are checked on
+// every row, but they only show up once buffers are flushed to a closed connection.
+const streamCheckRows = 1000
+
+// streamSummary is written as the last record of a streamed response that was cut short by MaxStreamBytes.
+// Repeating the request with the cursor continues exactly where the response stopped.
+type streamSummary struct {
+	Truncated bool   `json:"truncated"`
+	Rows      int64  `json:"rows"`
+	Cursor    string `json:"cursor"`
+}
+
+// byteBudget tracks how much of MaxStreamBytes a streamed response has used
+type byteBudget struct {
+	max  int64
+	used int64
+}
+
+// take reserves n bytes for the next record. First record is always allowed, otherwise a record larger than
+// the limit would make it impossible to resume.
+func (b *byteBudget) take(n int64, rows int64) bool {
+	if b.max > 0 && rows > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+func TestByteBudgetTake(t *testing.T) {
+	type take struct {
+		n       int64
+		allowed bool
+	}
+	tests := []struct {
+		name  string
+		max   int64
+		takes []take
+	}{
+		{
+			name:  "unlimited",
+			max:   0,
+			takes: []take{{n: 1 << 40, allowed: true}, {n: 1 << 40, allowed: true}},
+		},
+		{
+			name:  "up to the limit",
+			max:   10,
+			takes: []take{{n: 4, allowed: true}, {n: 6, allowed: true}, {n: 1, allowed: false}},
+		},
+		{
+			name:  "first record over the limit",
+			max:   10,
+			takes: []take{{n: 20, allowed: true}, {n: 1, allowed: false}},
+		},
+		{
+			// A rejected record doesn't use the budget, but nothing is written after it anyway
+			name:  "rejected record",
+			max:   10,
+			takes: []take{{n: 8, allowed: true}, {n: 5, allowed: false}, {n: 2, allowed: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &byteBudget{max: tt.max}
+			rows := int64(0)
+			for i, tk := range tt.takes {
+				if allowed := b.take(tk.n, rows); allowed != tk.allowed {
+					t.Fatalf("take %v: expected %v, got %v", i, tk.allowed, allowed)
+				}
+				if tk.allowed {
+					rows++
+				}
+			}
+		})
+	}
+}
+
+// With a budget of a single byte every response holds one row, so the cursor must move by exactly one node in
+// pre-order: [disk], [free], a, b, c, d, e
+func TestNDJSONCursor(t *testing.T) {
+	config.MaxStreamBytes = 1
+	defer func() { config.MaxStreamBytes = 0 }()
+
+	preOrder := []int64{types.RootElementId, types.RootElementId + 1, 3, 4, 5, 6, 7}
+	tests := []struct {
+		cursor   int64
+		ids      []int64
+		expected string
+	}{
+		{cursor: 0, ids: preOrder[:1], expected: "1"},
+		{cursor: 1, ids: preOrder[1:2], expected: "2"},
+		{cursor: 4, ids: preOrder[4:5], expected: "5"},
+		{cursor: 6, ids: preOrder[6:], expected: ""},
+		{cursor: 7, ids: nil, expected: ""},
+		{cursor: 100, ids: nil, expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.FormatInt(tt.cursor, 10), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/get?format=ndjson", nil)
+			if err := writeNDJSON(w, req, testTree(), tt.cursor); err != nil {
+				t.Fatal(err)
+			}
+			nodes, cursor := readNDJSON(t, w.Body)
+			if cursor != tt.expected {
+				t.Errorf("expected cursor %q, got %q", tt.expected, cursor)
+			}
+			if len(nodes) != len(tt.ids) {
+				t.Fatalf("expected %v nodes, got %v", len(tt.ids), len(nodes))
+			}
+			for i, n := range nodes {
+				if n.Id != tt.ids[i] {
+					t.Errorf("node %v: expected id %v, got %v", i, tt.ids[i], n.Id)
+				}
+			}
+		})
+	}
+}
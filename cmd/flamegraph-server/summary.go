@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type snapshotSummary struct {
+	Cluster   string
+	Timestamp int64
+	Nodes     uint64
+	Total     int64
+	Metadata  map[string]string
+	// ValueHistogram is amount of leaves (metrics) per decade of value, it shows whether the snapshot is dominated
+	// by a few large metrics or many small ones. Empty leaves are in the bucket with From and To of 0.
+	ValueHistogram []histogramBucket
+}
+
+type histogramBucket struct {
+	From  int64
+	To    int64
+	Count uint64
+}
+
+// getValueHistogram counts leaves in log10 buckets of value: [0, 0], [1, 10), [10, 100) and so on
+func getValueHistogram(ctx context.Context, graphType, cluster string, ts int64, date string) ([]histogramBucket, error) {
+	rows, err := config.db.QueryContext(ctx, "SELECT if(value <= 0, -1, toInt32(floor(log10(value)))) AS bucket, count() FROM flamegraph WHERE graph_type=? AND timestamp=? AND cluster=? AND date=? AND length(children_ids) = 0 GROUP BY bucket ORDER BY bucket", graphType, ts, cluster, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []histogramBucket
+	for rows.Next() {
+		var bucket int32
+		var count uint64
+		err = rows.Scan(&bucket, &count)
+		if err != nil {
+			return nil, err
+		}
+		b := histogramBucket{Count: count}
+		if bucket >= 0 {
+			b.From = int64(math.Pow10(int(bucket)))
+			b.To = b.From * 10
+		}
+		res = append(res, b)
+	}
+	return res, rows.Err()
+}
+
+// getSnapshotMetadata returns metadata that collector stored alongside the snapshot (tool version, config hash, etc).
+// The table is shared with circuit breaker state and other graph types, so the lookup is per graph type. Labels are
+// set by users later and are returned by /timestamps, they are not part of the snapshot.
+func getSnapshotMetadata(ctx context.Context, graphType, cluster string, ts int64) (map[string]string, error) {
+	rows, err := config.db.QueryContext(ctx, "SELECT key, argMax(value, version) FROM flamegraph_metadata WHERE graph_type=? AND cluster=? AND timestamp=? AND key != ? group by key", graphType, cluster, ts, labelKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			return nil, err
+		}
+		metadata[k] = v
+	}
+
+	return metadata, rows.Err()
+}
+
+func getSummary(ctx context.Context, graphType, cluster string, ts int64) (*snapshotSummary, error) {
+	date := time.Unix(ts, 0).Format("2006-01-02")
+	rows, err := config.db.QueryContext(ctx, "SELECT uniq(id), max(total) FROM flamegraph WHERE graph_type=? AND timestamp=? AND cluster=? AND date=?", graphType, ts, cluster, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &snapshotSummary{
+		Cluster:   cluster,
+		Timestamp: ts,
+	}
+	for rows.Next() {
+		err = rows.Scan(&summary.Nodes, &summary.Total)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	summary.Metadata, err = getSnapshotMetadata(ctx, graphType, cluster, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	summary.ValueHistogram, err = getValueHistogram(ctx, graphType, cluster, ts, date)
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// Handler for the request /summary?cluster=cluster&ts=timestamp&graph_type=type
+func summaryHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "summary"))
+
+	cluster := req.FormValue("cluster")
+	ts := req.FormValue("ts")
+	if cluster == "" || ts == "" {
+		logger.Error("You must specify cluster and ts",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		return
+	}
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("timestamp", ts),
+		zap.String("graph_type", graphType),
+	)
+
+	if !knownGraphTypes[graphType] {
+		logger.Error("Unknown graph type",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'graph_type'", http.StatusBadRequest)
+		return
+	}
+
+	tsInt, err := parseTime(ts, t0)
+	if err != nil {
+		logger.Error("Error parsing ts",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	summary, err := getSummary(ctx, graphType, cluster, tsInt)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error fetching data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(summary)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
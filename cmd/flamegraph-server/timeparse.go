@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeSyntax documents what parseTime accepts, it's shown on /formats
+const timeSyntax = "Time parameters (ts, ts1, ts2, from, until) accept unix seconds (1500000000), RFC3339 (2017-07-14T02:40:00Z or with an offset) and relative times resolved against the request time: now, -30s, -15min, -1h, -7d, -2w, -1mon, -1y, also in now-1h form."
+
+var relativeUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	// Longer suffixes go first, so "min" and "mon" are not taken for "m"
+	{"min", time.Minute},
+	{"mon", 30 * 24 * time.Hour},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+func parseRelative(s string, now time.Time) (int64, bool) {
+	s = strings.TrimPrefix(s, "now")
+	if s == "" {
+		return now.Unix(), true
+	}
+	if s[0] != '-' && s[0] != '+' {
+		return 0, false
+	}
+	for _, u := range relativeUnits {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(s[1:len(s)-len(u.suffix)], 10, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		d := time.Duration(n) * u.unit
+		if s[0] == '-' {
+			d = -d
+		}
+		return now.Add(d).Unix(), true
+	}
+	return 0, false
+}
+
+// isUnixTime reports whether s is a time in unix seconds. Such a time names a snapshot exactly, while relative and
+// RFC3339 times rarely hit the second a snapshot was taken at.
+func isUnixTime(s string) bool {
+	_, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return err == nil
+}
+
+// parseTime parses time parameter in any of the formats described by timeSyntax
+func parseTime(s string, now time.Time) (int64, error) {
+	s = strings.TrimSpace(s)
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	if ts, ok := parseRelative(s, now); ok {
+		return ts, nil
+	}
+	return 0, fmt.Errorf("%q is neither unix seconds, RFC3339 nor relative time (now, -1h, -7d)", s)
+}
+
+// parseTimeRange parses from and until, empty values mean beginning of time and now
+func parseTimeRange(fromStr, untilStr string, now time.Time) (int64, int64, error) {
+	from, until := int64(0), now.Unix()
+	var err error
+	if fromStr != "" {
+		if from, err = parseTime(fromStr, now); err != nil {
+			return 0, 0, fmt.Errorf("from: %v", err)
+		}
+	}
+	if untilStr != "" {
+		if until, err = parseTime(untilStr, now); err != nil {
+			return 0, 0, fmt.Errorf("until: %v", err)
+		}
+	}
+	if from >= until {
+		return 0, 0, fmt.Errorf("from (%v) must be before until (%v)", time.Unix(from, 0).UTC().Format(time.RFC3339), time.Unix(until, 0).UTC().Format(time.RFC3339))
+	}
+	return from, until, nil
+}
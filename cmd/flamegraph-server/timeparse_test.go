@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2021, 3, 28, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in       string
+		expected time.Time
+	}{
+		{"1500000000", time.Unix(1500000000, 0)},
+		{" 1500000000 ", time.Unix(1500000000, 0)},
+		{"0", time.Unix(0, 0)},
+
+		{"now", now},
+		{"-30s", now.Add(-30 * time.Second)},
+		{"-15min", now.Add(-15 * time.Minute)},
+		{"-15m", now.Add(-15 * time.Minute)},
+		{"-1h", now.Add(-time.Hour)},
+		{"now-1h", now.Add(-time.Hour)},
+		{"+2h", now.Add(2 * time.Hour)},
+		{"now+2h", now.Add(2 * time.Hour)},
+		{"-7d", now.Add(-7 * 24 * time.Hour)},
+		{"-2w", now.Add(-14 * 24 * time.Hour)},
+		{"-1mon", now.Add(-30 * 24 * time.Hour)},
+		{"now-1mon", now.Add(-30 * 24 * time.Hour)},
+		{"-1y", now.Add(-365 * 24 * time.Hour)},
+
+		{"2017-07-14T02:40:00Z", time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)},
+		{"2017-07-14T04:40:00+02:00", time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)},
+		{"2017-07-13T21:40:00-05:00", time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)},
+		{"2017-07-14T08:10:00+05:30", time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)},
+		// Europe/Berlin switches from +01:00 to +02:00 at 2021-03-28T01:00:00Z: the last second before the switch
+		// and the first one after it are a second apart, even though local clocks jump by an hour
+		{"2021-03-28T01:59:59+01:00", time.Date(2021, 3, 28, 0, 59, 59, 0, time.UTC)},
+		{"2021-03-28T03:00:00+02:00", time.Date(2021, 3, 28, 1, 0, 0, 0, time.UTC)},
+		// and back at 2021-10-31T01:00:00Z, 02:30 local happens twice and the offset tells which one is meant
+		{"2021-10-31T02:30:00+02:00", time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC)},
+		{"2021-10-31T02:30:00+01:00", time.Date(2021, 10, 31, 1, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseTime(tt.in, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected.Unix() {
+				t.Errorf("expected %v, got %v", tt.expected.UTC().Format(time.RFC3339), time.Unix(got, 0).UTC().Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestParseTimeErrors(t *testing.T) {
+	now := time.Date(2021, 3, 28, 12, 0, 0, 0, time.UTC)
+	for _, in := range []string{
+		"yesterday",
+		"1h",
+		"--1h",
+		"-1.5h",
+		"-h",
+		"-1x",
+		"now-",
+		"2017-07-14 02:40:00",
+		"2017-07-14T02:40:00",
+	} {
+		t.Run(in, func(t *testing.T) {
+			if got, err := parseTime(in, now); err == nil {
+				t.Errorf("expected error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	now := time.Date(2021, 3, 28, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		from, until   string
+		expectedFrom  int64
+		expectedUntil int64
+		err           string
+	}{
+		{name: "defaults", expectedFrom: 0, expectedUntil: now.Unix()},
+		{name: "relative", from: "-1d", until: "now-1h", expectedFrom: now.Add(-24 * time.Hour).Unix(), expectedUntil: now.Add(-time.Hour).Unix()},
+		{name: "mixed", from: "1600000000", until: "2021-03-28T03:00:00+02:00", expectedFrom: 1600000000, expectedUntil: time.Date(2021, 3, 28, 1, 0, 0, 0, time.UTC).Unix()},
+		{name: "from equals until", from: "-1h", until: "now-1h", err: "must be before until"},
+		{name: "from after until", from: "-1h", until: "-2h", err: "must be before until"},
+		{name: "from after default until", from: "+1h", err: "must be before until"},
+		{name: "invalid from", from: "yesterday", err: "from:"},
+		{name: "invalid until", until: "tomorrow", err: "until:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, until, err := parseTimeRange(tt.from, tt.until, now)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if from != tt.expectedFrom || until != tt.expectedUntil {
+				t.Errorf("expected [%v, %v], got [%v, %v]", tt.expectedFrom, tt.expectedUntil, from, until)
+			}
+		})
+	}
+}
+
+func TestIsUnixTime(t *testing.T) {
+	tests := map[string]bool{
+		"1500000000":           true,
+		" 1500000000 ":         true,
+		"-1h":                  false,
+		"now":                  false,
+		"2017-07-14T02:40:00Z": false,
+	}
+	for in, expected := range tests {
+		if got := isUnixTime(in); got != expected {
+			t.Errorf("isUnixTime(%q): expected %v, got %v", in, expected, got)
+		}
+	}
+}
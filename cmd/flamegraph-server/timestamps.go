@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+const (
+	defaultTimestampsLimit = 100
+	maxTimestampsLimit     = 10000
+)
+
+// latestSnapshot returns timestamp of the most recent snapshot of the cluster taken at or before until, 0 if there
+// are none
+func latestSnapshot(ctx context.Context, cluster, graphType string, until int64) (int64, error) {
+	var ts int64
+	err := config.db.QueryRowContext(ctx, "SELECT max(timestamp) FROM flamegraph_timestamps WHERE cluster=? AND graph_type=? AND timestamp <= ?", cluster, graphType, until).Scan(&ts)
+	return ts, err
+}
+
+// Handler for the request /timestamps?cluster=cluster&graph_type=type&limit=n
+// Returns timestamps of stored snapshots of the cluster, newest first, so UI can offer a time picker
+func timestampsHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	logger := logger.With(zap.String("handler", "timestamps"))
+
+	cluster := req.FormValue("cluster")
+	if cluster == "" {
+		logger.Error("You must specify cluster",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'cluster'", http.StatusBadRequest)
+		return
+	}
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("graph_type", graphType),
+	)
+
+	if !knownGraphTypes[graphType] {
+		logger.Error("Unknown graph type",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Unknown 'graph_type'", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultTimestampsLimit
+	if limitStr := req.FormValue("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxTimestampsLimit {
+			logger.Error("Error parsing limit",
+				zap.String("limit", limitStr),
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusBadRequest),
+			)
+			http.Error(w, "Error parsing 'limit'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := req.Context()
+	cacheKey := "timestamps&" + cluster + "&" + graphType + "&" + strconv.Itoa(limit)
+	// Only timestamps are cached, labels can change any time and are always read
+	var timestamps []int64
+	cached, ok := config.queryCache.get(cacheKey)
+	if ok {
+		ok = json.Unmarshal(cached, &timestamps) == nil
+	}
+	if !ok {
+		var err error
+		timestamps, err = getTimestampsList(ctx, graphType, cluster, limit)
+		if err != nil {
+			if clientGone(ctx) {
+				logAbandoned(logger, t0, err)
+				return
+			}
+			requestsFailed.Add(1)
+			logger.Error("Error during database query",
+				zap.Duration("runtime", time.Since(t0)),
+				zap.Int("http_code", http.StatusInternalServerError),
+				zap.Error(err),
+			)
+			http.Error(w, "Error fetching data",
+				http.StatusInternalServerError)
+			return
+		}
+		accountRows(ctx, int64(len(timestamps)))
+		if b, err := json.Marshal(timestamps); err == nil {
+			config.queryCache.set(cacheKey, b, int32(config.RerunInterval.Seconds()))
+		}
+	}
+
+	labels, err := getLabels(ctx, graphType, cluster, timestamps)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error fetching labels",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		Cluster    string  `json:"cluster"`
+		GraphType  string  `json:"graph_type"`
+		Timestamps []int64 `json:"timestamps"`
+		// Labels maps timestamps to labels, only labeled snapshots are there
+		Labels map[int64]string `json:"labels,omitempty"`
+	}{
+		Cluster:    cluster,
+		GraphType:  graphType,
+		Timestamps: timestamps,
+		Labels:     labels,
+	})
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Int("timestamps", len(timestamps)),
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
+
+// getTimestampsList returns up to limit timestamps of snapshots of the cluster, newest first
+func getTimestampsList(ctx context.Context, graphType, cluster string, limit int) ([]int64, error) {
+	rows, err := config.db.QueryContext(ctx, "SELECT DISTINCT timestamp FROM flamegraph WHERE graph_type=? AND cluster=? AND id=? ORDER BY timestamp DESC LIMIT ?", graphType, cluster, types.RootElementId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timestamps := make([]int64, 0)
+	for rows.Next() {
+		var ts int64
+		err = rows.Scan(&ts)
+		if err != nil {
+			return nil, err
+		}
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps, rows.Err()
+}
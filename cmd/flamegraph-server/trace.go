@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type traceKeyType struct{}
+
+var traceKey traceKeyType
+
+// debugLogger logs at debug level regardless of the global level. It's used only for requests with debug=1
+var debugLogger *zap.Logger
+
+// requestTrace collects what happened during a single request with debug=1 (queries, row counts, timings)
+type requestTrace struct {
+	sync.Mutex
+	logger *zap.Logger
+	t0     time.Time
+	events []string
+}
+
+func traceFromContext(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(traceKey).(*requestTrace)
+	return t
+}
+
+// event logs the event at debug level and remembers it for the response header. Safe to call on nil trace.
+func (t *requestTrace) event(name string, fields ...zapcore.Field) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(t.t0)
+	t.logger.Debug(name, append(fields, zap.Duration("elapsed", elapsed))...)
+
+	t.Lock()
+	t.events = append(t.events, name+"@"+elapsed.String())
+	t.Unlock()
+}
+
+// setHeader adds condensed trace to the response. Must be called before response body is written.
+func (t *requestTrace) setHeader(w http.ResponseWriter) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	w.Header().Set("X-Flamegraph-Trace", strings.Join(t.events, "; "))
+	t.Unlock()
+}
+
+// requestLogger returns debug logger for traced requests and normal logger otherwise
+func requestLogger(ctx context.Context, handler string) *zap.Logger {
+	if traceFromContext(ctx) != nil {
+		return debugLogger.With(zap.String("handler", handler))
+	}
+	return logger.With(zap.String("handler", handler))
+}
+
+// debugTrace enables tracing for requests with debug=1. Only admins are allowed to do that, for everyone else
+// the parameter is ignored so it can't be used to flood the logs.
+func debugTrace(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("debug") != "1" || !isAdmin(r) {
+			fn(w, r)
+			return
+		}
+
+		t := &requestTrace{
+			logger: debugLogger.With(
+				zap.String("uri", r.RequestURI),
+				zap.String("identity", clientIdentity(r)),
+			),
+			t0: time.Now(),
+		}
+		fn(w, r.WithContext(context.WithValue(r.Context(), traceKey, t)))
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// Copied from github.com/dgryski/carbonapi
+
+type limiter chan struct{}
+
+func (l limiter) enter() { l <- struct{}{} }
+func (l limiter) leave() { <-l }
+
+func newLimiter(l int) limiter {
+	return make(chan struct{}, l)
+}
+
+// End of copy from carbonapi
+
+const defaultGraphType = "graphite_metrics"
+
+// defaultMaxLevel is how deep the tree is reconstructed if request doesn't say otherwise
+const defaultMaxLevel = 12
+
+// deltaGraphType holds day-over-day differences: growth is stored in value and shrinkage in value_negative
+const deltaGraphType = "graphite_metrics_delta_1d"
+
+// knownGraphTypes are graph types that can be requested. Rollups and deltas are synthetic snapshots built out of regular ones
+var knownGraphTypes = map[string]bool{
+	defaultGraphType:     true,
+	"rollup_max_weekly":  true,
+	"rollup_max_monthly": true,
+	deltaGraphType:       true,
+	"prometheus_series":  true,
+}
+
+// treeRequest describes a single flamegraph that should be fetched from ClickHouse
+type treeRequest struct {
+	graphType    string
+	cluster      string
+	ts           int64
+	maxLevel     int64
+	column       string
+	removeLowest float64
+	// minValue, if set, is used as an absolute trimming threshold instead of removeLowest
+	minValue int64
+}
+
+// getTree fetches flattened data for the request and reconstructs the tree out of it.
+// Amount of concurrent queries to ClickHouse is limited by MaxConcurrentQueries
+func getTree(ctx context.Context, r *treeRequest) (*types.FlameGraphNode, error) {
+	trace := traceFromContext(ctx)
+	config.queryLimiter.enter()
+	defer config.queryLimiter.leave()
+	trace.event("query slot acquired")
+
+	date := time.Unix(r.ts, 0).Format("2006-01-02")
+
+	graphType := r.graphType
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+	if !knownGraphTypes[graphType] {
+		return nil, fmt.Errorf("unknown graph type %v", graphType)
+	}
+
+	where := " timestamp=? AND graph_type=? AND cluster=? AND date=? AND level<?"
+	whereArgs := []interface{}{r.ts, graphType, r.cluster, date, r.maxLevel}
+
+	query := "SELECT sum(total) FROM flamegraph WHERE" + where + " AND name = '[disk]' group by timestamp"
+	rows, err := config.db.QueryContext(ctx, query, whereArgs...)
+	if err != nil {
+		return nil, err
+	}
+	total := uint64(0)
+	for rows.Next() {
+		err = rows.Scan(&total)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	trace.event("total fetched",
+		zap.String("query", query),
+		zap.Uint64("total", total),
+	)
+
+	minValue := r.minValue
+	if minValue == 0 {
+		minValue = int64(float64(total) * r.removeLowest)
+	}
+
+	// For deltas, nodes are sized by the absolute change and the signed one is returned separately
+	column, filter, negative := r.column, "value", "0"
+	if graphType == deltaGraphType {
+		column, filter, negative = "value", "(value + value_negative)", "sum(value_negative)"
+	}
+
+	query = "SELECT timestamp, cluster, id, any(name), any(parent_id), sum(total), sum(" + column + "), " + negative + ", any(" + helper.ChildrenIdsColumn + "), max(children_truncated) FROM flamegraph WHERE" + where + " AND " + filter + " > ? group by timestamp, cluster, id"
+	rows, err = config.db.QueryContext(ctx, query, append(whereArgs, minValue)...)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[int64]types.ClickhouseField)
+	defer func() {
+		accountRows(ctx, int64(len(data)))
+	}()
+	for rows.Next() {
+		var res types.ClickhouseField
+		var negative int64
+		err := rows.Scan(&res.Timestamp, &res.Cluster, &res.Id, &res.Name, &res.ParentID, &res.Total, &res.Value, &negative, &res.ChildrenIds, &res.ChildrenTruncated)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if graphType == deltaGraphType {
+			res.Delta = res.Value - negative
+			res.Value += negative
+		}
+		if len(data)%helper.MemoryCheckInterval == 0 {
+			if err := helper.CheckMemoryLimit(config.MemoryLimitMB); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		data[res.Id] = res
+	}
+	err = rows.Err()
+	rows.Close()
+	if ctx.Err() != nil {
+		// rows.Next() stops as soon as context is cancelled, so there is no point to continue
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	trace.event("data fetched",
+		zap.String("query", query),
+		zap.Int("rows", len(data)),
+	)
+
+	flameGraphTreeRoot := &types.FlameGraphNode{
+		Id:          data[types.RootElementId].Id,
+		Cluster:     data[types.RootElementId].Cluster,
+		Name:        data[types.RootElementId].Name,
+		Value:       data[types.RootElementId].Value,
+		Delta:       data[types.RootElementId].Delta,
+		Total:       data[types.RootElementId].Total,
+		Parent:      nil,
+		ChildrenIds: data[types.RootElementId].ChildrenIds,
+
+		ChildrenTruncated: data[types.RootElementId].ChildrenTruncated != 0,
+	}
+
+	if r.column == "mtime" {
+		flameGraphTreeRoot.Total = data[types.RootElementId].Value
+	}
+
+	capped := helper.ReconstructTree(data, flameGraphTreeRoot, minValue, config.MaxChildrenPerNode)
+	if capped > 0 {
+		cappedNodes.Add(int64(capped))
+		logger.Warn("nodes have more children than MaxChildrenPerNode, the rest were skipped",
+			zap.String("cluster", r.cluster),
+			zap.Int64("timestamp", r.ts),
+			zap.Int("capped_nodes", capped),
+			zap.Int("max_children_per_node", config.MaxChildrenPerNode),
+		)
+	}
+	flameGraphTreeRoot.UnreachableValue = unreachableValue(flameGraphTreeRoot, data, minValue)
+	flameGraphTreeRoot.FormatVersion = treeFormatVersion
+	trace.event("tree reconstructed",
+		zap.Int64("unreachable_value", flameGraphTreeRoot.UnreachableValue),
+	)
+
+	if len(flameGraphTreeRoot.Children) == 0 && len(flameGraphTreeRoot.ChildrenIds) > 0 && minValue > 0 {
+		// Everything was trimmed, tell user what threshold would show something instead of returning an empty graph
+		largest, err := getLargestChildValue(ctx, where, whereArgs, r.column)
+		if err != nil {
+			return nil, err
+		}
+		flameGraphTreeRoot.Children = append(flameGraphTreeRoot.Children, newTrimmedNode(flameGraphTreeRoot, largest, total))
+	}
+
+	return flameGraphTreeRoot, nil
+}
+
+// unreachableValue returns total value of rows that passed the filter but couldn't be attached to the tree,
+// e.g. because their parent was trimmed or they were dropped from parent's children_ids. Only topmost of such rows
+// are counted, as their values already include descendants.
+func unreachableValue(root *types.FlameGraphNode, data map[int64]types.ClickhouseField, minValue int64) int64 {
+	reached := make(map[int64]bool)
+	var walk func(n *types.FlameGraphNode)
+	walk = func(n *types.FlameGraphNode) {
+		reached[n.Id] = true
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	orphaned := func(id int64) bool {
+		r, ok := data[id]
+		return ok && !reached[id] && r.Value > minValue
+	}
+
+	res := int64(0)
+	for id, r := range data {
+		if orphaned(id) && !orphaned(r.ParentID) {
+			res += r.Value
+		}
+	}
+	return res
+}
+
+// findByPrefix returns node at the dotted path relative to the root or nil if it's not in the tree,
+// for example because it was trimmed
+func findByPrefix(root *types.FlameGraphNode, prefix string) *types.FlameGraphNode {
+	node := root
+	for _, part := range strings.Split(prefix, ".") {
+		if part == "" {
+			continue
+		}
+		var next *types.FlameGraphNode
+		for _, c := range node.Children {
+			if c.Name == part {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		node = next
+	}
+	return node
+}
+
+func getLargestChildValue(ctx context.Context, where string, whereArgs []interface{}, column string) (int64, error) {
+	rows, err := config.db.QueryContext(ctx, "SELECT max(v) FROM (SELECT sum("+column+") AS v FROM flamegraph WHERE"+where+" AND parent_id = ? group by id)", append(whereArgs, types.RootElementId)...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	largest := int64(0)
+	for rows.Next() {
+		err = rows.Scan(&largest)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return largest, rows.Err()
+}
+
+// newTrimmedNode returns a node that explains why the graph is empty. It spans the whole root so it's visible in UI.
+func newTrimmedNode(root *types.FlameGraphNode, largest int64, total uint64) *types.FlameGraphNode {
+	pct := float64(0)
+	if total > 0 {
+		pct = 100 * float64(largest) / float64(total)
+	}
+	return &types.FlameGraphNode{
+		Cluster: root.Cluster,
+		Name:    fmt.Sprintf("(everything trimmed: largest child is %.4f%% of total, set removePct below that)", pct),
+		Value:   root.Value,
+		Total:   root.Total,
+		Parent:  root,
+
+		Synthetic: true,
+	}
+}
+
+// foldToCoverage keeps, for every node, the largest children that together make up coverage of its value and
+// folds the rest into a single synthetic "(other)" child, so the widths are preserved
+func foldToCoverage(node *types.FlameGraphNode, coverage float64) {
+	sort.Slice(node.Children, func(i, j int) bool {
+		return node.Children[i].Value > node.Children[j].Value
+	})
+
+	target := int64(math.Ceil(float64(node.Value) * coverage))
+	kept := int64(0)
+	for i, c := range node.Children {
+		if kept >= target {
+			other := &types.FlameGraphNode{
+				Cluster: node.Cluster,
+				Name:    fmt.Sprintf("(other: %d nodes)", len(node.Children)-i),
+				Total:   node.Total,
+				Parent:  node,
+
+				Synthetic: true,
+			}
+			for _, folded := range node.Children[i:] {
+				other.Value += folded.Value
+			}
+			node.Children = append(node.Children[:i], other)
+			break
+		}
+		kept += c.Value
+		foldToCoverage(c, coverage)
+	}
+}
+
+// parseIds parses comma separated list of node ids
+func parseIds(s string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a node id", part)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// excludeIds prunes subtrees of the given nodes. Their value is folded into a single synthetic "(excluded)" child
+// of every affected parent, so the widths are preserved. Root can't be excluded.
+func excludeIds(node *types.FlameGraphNode, ids map[int64]bool) {
+	var excluded *types.FlameGraphNode
+	children := node.Children[:0]
+	for _, c := range node.Children {
+		if !ids[c.Id] || c.Synthetic {
+			excludeIds(c, ids)
+			children = append(children, c)
+			continue
+		}
+		if excluded == nil {
+			excluded = &types.FlameGraphNode{
+				Cluster: node.Cluster,
+				Name:    "(excluded)",
+				Total:   node.Total,
+				Parent:  node,
+
+				Synthetic: true,
+			}
+		}
+		excluded.Value += c.Value
+	}
+	if excluded != nil {
+		children = append(children, excluded)
+	}
+	node.Children = children
+}
+
+// removeSynthetic drops synthetic nodes from the tree
+func removeSynthetic(node *types.FlameGraphNode) {
+	children := node.Children[:0]
+	for _, c := range node.Children {
+		if c.Synthetic {
+			continue
+		}
+		removeSynthetic(c)
+		children = append(children, c)
+	}
+	node.Children = children
+}
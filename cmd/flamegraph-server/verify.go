@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Civil/ch-flamegraphs/helper"
+)
+
+// checksumMismatches counts snapshots whose stored rows don't match the checksum computed by the collector
+var checksumMismatches = expvar.NewInt("checksum_mismatches")
+
+type verifyResult struct {
+	Cluster   string `json:"cluster"`
+	GraphType string `json:"graph_type"`
+	Timestamp int64  `json:"timestamp"`
+	Rows      int    `json:"rows"`
+	Version   string `json:"checksum_version,omitempty"`
+	Stored    string `json:"stored,omitempty"`
+	Computed  string `json:"computed,omitempty"`
+	// Match is nil if the snapshot has no checksum or its version is not supported
+	Match   *bool  `json:"match"`
+	Message string `json:"message,omitempty"`
+}
+
+// verifySnapshot recomputes checksum of the stored snapshot and compares it with the one collector stored in
+// metadata. Mismatches are logged and counted.
+func verifySnapshot(ctx context.Context, cluster, graphType string, ts int64) (*verifyResult, error) {
+	res := &verifyResult{
+		Cluster:   cluster,
+		GraphType: graphType,
+		Timestamp: ts,
+	}
+
+	rows, err := config.db.QueryContext(ctx, "SELECT key, argMax(value, version) FROM flamegraph_metadata WHERE graph_type=? AND cluster=? AND timestamp=? AND key IN (?, ?) GROUP BY key", graphType, cluster, ts, helper.ChecksumVersionKey, helper.ChecksumKey)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch k {
+		case helper.ChecksumVersionKey:
+			res.Version = v
+		case helper.ChecksumKey:
+			res.Stored = v
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	date := time.Unix(ts, 0).Format("2006-01-02")
+	rows, err = config.db.QueryContext(ctx, "SELECT id, parent_id, name, value FROM flamegraph WHERE graph_type=? AND cluster=? AND timestamp=? AND date=?", graphType, cluster, ts, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []helper.ChecksumNode
+	processed := 0
+	for rows.Next() {
+		var n helper.ChecksumNode
+		err = rows.Scan(&n.Id, &n.ParentID, &n.Name, &n.Value)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+		processed++
+		if processed%helper.MemoryCheckInterval == 0 {
+			if err := helper.CheckMemoryLimit(config.MemoryLimitMB); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	res.Rows = len(nodes)
+
+	if res.Stored == "" {
+		res.Message = "snapshot has no checksum, it was stored by an older collector or is computed in ClickHouse"
+		return res, nil
+	}
+	res.Computed, err = helper.SnapshotChecksum(res.Version, nodes)
+	if err != nil {
+		res.Message = err.Error()
+		return res, nil
+	}
+
+	match := res.Computed == res.Stored
+	res.Match = &match
+	if !match {
+		checksumMismatches.Add(1)
+		logger.Warn("snapshot checksum mismatch",
+			zap.String("cluster", cluster),
+			zap.String("graph_type", graphType),
+			zap.Int64("timestamp", ts),
+			zap.Int("rows", res.Rows),
+			zap.String("stored", res.Stored),
+			zap.String("computed", res.Computed),
+		)
+	}
+	return res, nil
+}
+
+// Handler for the request /verify?cluster=cluster&ts=timestamp&graph_type=type
+// Reads every row of the snapshot, so it's as expensive as /export of a single snapshot.
+func verifyHandler(w http.ResponseWriter, req *http.Request) {
+	t0 := time.Now()
+	ctx := req.Context()
+	logger := requestLogger(ctx, "verify")
+
+	cluster := req.FormValue("cluster")
+	ts := req.FormValue("ts")
+	if cluster == "" || ts == "" {
+		logger.Error("You must specify cluster and ts",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts' or 'cluster'", http.StatusBadRequest)
+		return
+	}
+	graphType := req.FormValue("graph_type")
+	if graphType == "" {
+		graphType = defaultGraphType
+	}
+
+	logger = logger.With(
+		zap.String("cluster", cluster),
+		zap.String("timestamp", ts),
+		zap.String("graph_type", graphType),
+	)
+
+	tsInt, err := parseTime(ts, t0)
+	if err != nil {
+		logger.Error("Error parsing ts",
+			zap.Error(err),
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusBadRequest),
+		)
+		http.Error(w, "Error parsing 'ts': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := verifySnapshot(ctx, cluster, graphType, tsInt)
+	if err != nil {
+		if clientGone(ctx) {
+			logAbandoned(logger, t0, err)
+			return
+		}
+		requestsFailed.Add(1)
+		logger.Error("Error fetching data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		logger.Error("Error marshaling data",
+			zap.Duration("runtime", time.Since(t0)),
+			zap.Int("http_code", http.StatusInternalServerError),
+			zap.Error(err),
+		)
+		http.Error(w, "Error fetching data",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	if err != nil {
+		logAbandoned(logger, t0, err)
+		return
+	}
+
+	logger.Info("request served",
+		zap.Duration("runtime", time.Since(t0)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
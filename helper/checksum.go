@@ -0,0 +1,68 @@
+package helper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Snapshot checksums are stored in metadata together with the version of canonicalization rules, so the
+// algorithm can change without invalidating checksums of older snapshots.
+const (
+	ChecksumVersionKey = "checksum_version"
+	ChecksumKey        = "checksum"
+
+	// ChecksumV1 is sha256 of "id\tparent_id\tname\tvalue\n" lines of all nodes sorted by id, parent_id, name
+	// and value
+	ChecksumV1 = "1"
+
+	CurrentChecksumVersion = ChecksumV1
+)
+
+// ChecksumNode is the part of a stored node that is covered by the checksum
+type ChecksumNode struct {
+	Id       int64
+	ParentID int64
+	Name     string
+	Value    int64
+}
+
+// SnapshotChecksum returns checksum of the nodes using canonicalization rules of the given version. Nodes are
+// sorted in place.
+func SnapshotChecksum(version string, nodes []ChecksumNode) (string, error) {
+	if version != ChecksumV1 {
+		return "", fmt.Errorf("unsupported checksum version %q", version)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := &nodes[i], &nodes[j]
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		if a.ParentID != b.ParentID {
+			return a.ParentID < b.ParentID
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Value < b.Value
+	})
+
+	h := sha256.New()
+	buf := make([]byte, 0, 256)
+	for _, n := range nodes {
+		buf = buf[:0]
+		buf = strconv.AppendInt(buf, n.Id, 10)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, n.ParentID, 10)
+		buf = append(buf, '\t')
+		buf = append(buf, n.Name...)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, n.Value, 10)
+		buf = append(buf, '\n')
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
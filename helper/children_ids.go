@@ -0,0 +1,20 @@
+package helper
+
+const (
+	ChildrenIdsPlain uint8 = 0
+	// ChildrenIdsDelta stores first id as is and every next id as a difference with the previous one
+	ChildrenIdsDelta uint8 = 1
+)
+
+// ChildrenIdsColumn decodes children_ids on the ClickHouse side, so readers always get plain ids
+const ChildrenIdsColumn = "if(children_ids_encoding = 1, arrayCumSum(children_ids), children_ids)"
+
+func DeltaEncodeIds(ids []int64) []int64 {
+	res := make([]int64, len(ids))
+	prev := int64(0)
+	for i, id := range ids {
+		res[i] = id - prev
+		prev = id
+	}
+	return res
+}
@@ -59,6 +59,8 @@ type ClickhouseSender struct {
 	txStart       time.Time
 
 	query string
+	// graphType is written by SendFg
+	graphType string
 
 	isHTTP bool
 	sendBuffer []byte
@@ -78,9 +80,14 @@ func NewClickhouseSender(db *sql.DB, query string, t int64, rowsPerInsert int) (
 		txStart:       time.Now(),
 		linesToBuffer: rowsPerInsert,
 		query:         query,
+		graphType:     "graphite_metrics",
 	}, nil
 }
 
+func (c *ClickhouseSender) SetGraphType(graphType string) {
+	c.graphType = graphType
+}
+
 func (c *ClickhouseSender) startTransaction() error {
 	var err error
 	c.tx, c.stmt, err = DBStartTransaction(c.db, c.query)
@@ -233,16 +240,14 @@ func (c *ClickhouseHTTPSender) Commit() error {
 
 	server := c.pickServer()
 
-	rewrite, _ := url.Parse("http://127.0.0.1/")
-
 	v := url.Values{
 		"query": []string{c.query + " FORMAT TabSeparated"},
 	}
-	rewrite.RawQuery = v.Encode()
-
-	u, err := url.Parse("http://" + server + ":8123" + rewrite.RequestURI())
-	if err != nil {
-		return err
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     HostWithDefaultPort(server, "8123"),
+		Path:     "/",
+		RawQuery: v.Encode(),
 	}
 
 	c.logger.Debug("doing request",
@@ -564,12 +569,17 @@ func (c *ClickhouseSender) sendFgNode(stmt *sql.Stmt, level int, timestamp int64
 	return err
 }
 
-func (c *ClickhouseSender) SendFg(cluster, name string, id int64, mtime int64, total, value, parentID int64, childrenIds []int64, level uint64) error {
+func (c *ClickhouseSender) SendFg(cluster, name string, id int64, mtime int64, total, value, parentID int64, childrenIds []int64, childrenIdsEncoding uint8, childrenTruncated bool, level uint64) error {
 	c.lines++
 
+	truncated := uint8(0)
+	if childrenTruncated {
+		truncated = 1
+	}
+
 	_, err := c.stmt.Exec(
 		c.version,
-		"graphite_metrics",
+		c.graphType,
 		cluster,
 		id,
 		name,
@@ -577,6 +587,8 @@ func (c *ClickhouseSender) SendFg(cluster, name string, id int64, mtime int64, t
 		value,
 		parentID,
 		clickhouse.Array(childrenIds),
+		childrenIdsEncoding,
+		truncated,
 		level,
 		mtime,
 		c.now,
@@ -591,7 +603,7 @@ func (c *ClickhouseSender) SendFg(cluster, name string, id int64, mtime int64, t
 		if err != nil {
 			return err
 		}
-		c.tx, c.stmt, err = DBStartTransaction(c.db, FlamegraphInsertQuery)
+		c.tx, c.stmt, err = DBStartTransaction(c.db, c.query)
 		if err != nil {
 			return err
 		}
@@ -733,6 +745,19 @@ func (c *ClickhouseSender) Commit() (int64, error) {
 	return c.commitedLines, c.tx.Commit()
 }
 
+// CommittedLines returns amount of lines that were already committed, they stay even if the rest fails
+func (c *ClickhouseSender) CommittedLines() int64 {
+	return c.commitedLines
+}
+
+// Rollback aborts the running transaction, so its connection goes back to the pool
+func (c *ClickhouseSender) Rollback() error {
+	if c.tx == nil {
+		return fmt.Errorf("no transaction running")
+	}
+	return c.tx.Rollback()
+}
+
 func (c *ClickhouseSender) CommitAndRenew(tx *sql.Tx, query string) error {
 	err := tx.Commit()
 	if err != nil {
@@ -747,3 +772,18 @@ func (c *ClickhouseSender) CommitAndRenew(tx *sql.Tx, query string) error {
 	c.txStart = time.Now()
 	return nil
 }
+
+// ValidateClickhouseDSN checks that dsn is something the driver can connect to, without connecting
+func ValidateClickhouseDSN(dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "tcp" {
+		return fmt.Errorf("clickhouse dsn %q must start with tcp://", dsn)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("clickhouse dsn %q has no host", dsn)
+	}
+	return nil
+}
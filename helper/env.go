@@ -0,0 +1,30 @@
+package helper
+
+import (
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// OverrideFromEnv replaces config fields with values of environment variables named prefix+key, e.x.
+// FLAMEGRAPH_SERVER_LISTEN. Variables that are set, even to an empty string, take precedence over the config file.
+func OverrideFromEnv(prefix string, fields map[string]*string) {
+	for key, field := range fields {
+		if v, ok := os.LookupEnv(prefix + key); ok {
+			*field = v
+		}
+	}
+}
+
+// NewLogger creates production logger with the given level (debug, info, warn, error). Empty level means info.
+func NewLogger(level string) (*zap.Logger, error) {
+	var l zapcore.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, err
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(l)
+	return cfg.Build()
+}
@@ -0,0 +1,70 @@
+package helper
+
+import (
+	"os"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestOverrideFromEnv(t *testing.T) {
+	const prefix = "HELPER_ENV_TEST_"
+	file := []byte("listen: \"[::]:8080\"\nloglevel: debug\nclickhousehost: tcp://file:9000\n")
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "no variables keep the file values",
+			expected: map[string]string{"listen": "[::]:8080", "loglevel": "debug", "clickhousehost": "tcp://file:9000"},
+		},
+		{
+			name:     "variable wins over the file value",
+			env:      map[string]string{"LISTEN": "127.0.0.1:9090"},
+			expected: map[string]string{"listen": "127.0.0.1:9090", "loglevel": "debug", "clickhousehost": "tcp://file:9000"},
+		},
+		{
+			name:     "empty variable wins over the file value",
+			env:      map[string]string{"LOG_LEVEL": ""},
+			expected: map[string]string{"listen": "[::]:8080", "loglevel": "", "clickhousehost": "tcp://file:9000"},
+		},
+		{
+			name:     "several variables",
+			env:      map[string]string{"LISTEN": ":1", "LOG_LEVEL": "error", "CLICKHOUSE_HOST": "tcp://env:9000"},
+			expected: map[string]string{"listen": ":1", "loglevel": "error", "clickhousehost": "tcp://env:9000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				if err := os.Setenv(prefix+k, v); err != nil {
+					t.Fatal(err)
+				}
+				defer os.Unsetenv(prefix + k)
+			}
+
+			var config struct {
+				Listen         string
+				LogLevel       string
+				ClickhouseHost string
+			}
+			if err := yaml.Unmarshal(file, &config); err != nil {
+				t.Fatal(err)
+			}
+			OverrideFromEnv(prefix, map[string]*string{
+				"LISTEN":          &config.Listen,
+				"LOG_LEVEL":       &config.LogLevel,
+				"CLICKHOUSE_HOST": &config.ClickhouseHost,
+			})
+
+			got := map[string]string{"listen": config.Listen, "loglevel": config.LogLevel, "clickhousehost": config.ClickhouseHost}
+			for k, v := range tt.expected {
+				if got[k] != v {
+					t.Errorf("%v: expected %q, got %q", k, v, got[k])
+				}
+			}
+		})
+	}
+}
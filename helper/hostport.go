@@ -0,0 +1,17 @@
+package helper
+
+import (
+	"net"
+	"strings"
+)
+
+// HostWithDefaultPort returns host in "host:port" form that is safe to put into url. Port that is already part
+// of the host ("10.0.0.1:8080", "[2001:db8::1]:8080") is kept, otherwise port is appended. IPv6 literals are
+// accepted with or without brackets.
+func HostWithDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,23 @@
+package helper
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// MemoryCheckInterval is how many items are processed between memory checks. Reading MemStats stops the world,
+// so it can't be done for every item.
+const MemoryCheckInterval = 1 << 16
+
+// CheckMemoryLimit returns an error if heap is larger than limitMB megabytes. Zero limit disables the check.
+func CheckMemoryLimit(limitMB uint64) error {
+	if limitMB == 0 {
+		return nil
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > limitMB*1024*1024 {
+		return fmt.Errorf("memory limit exceeded: heap is %v MB, limit is %v MB", m.HeapAlloc/1024/1024, limitMB)
+	}
+	return nil
+}
@@ -9,22 +9,36 @@ import (
 	"github.com/Civil/ch-flamegraphs/types"
 )
 
-func ReconstructTree(data map[int64]types.ClickhouseField, root *types.FlameGraphNode, minValue int64) {
-	for _, i := range root.ChildrenIds {
+// ReconstructTree attaches children listed in ChildrenIds to the root, recursively. If maxChildren is positive, only
+// that many ids of a node are looked at, so a corrupted or unexpectedly wide row can't blow up memory. Such nodes
+// are marked as truncated. It returns how many nodes were capped.
+func ReconstructTree(data map[int64]types.ClickhouseField, root *types.FlameGraphNode, minValue int64, maxChildren int) int {
+	capped := 0
+	ids := root.ChildrenIds
+	if maxChildren > 0 && len(ids) > maxChildren {
+		ids = ids[:maxChildren]
+		root.ChildrenTruncated = true
+		capped++
+	}
+	for _, i := range ids {
 		if data[i].Value > minValue {
 			node := &types.FlameGraphNode{
 				Id:          data[i].Id,
 				Cluster:     data[i].Cluster,
 				Name:        data[i].Name,
 				Value:       data[i].Value,
+				Delta:       data[i].Delta,
 				Total:       data[i].Total,
 				Parent:      root,
 				ChildrenIds: data[i].ChildrenIds,
+
+				ChildrenTruncated: data[i].ChildrenTruncated != 0,
 			}
-			ReconstructTree(data, node, minValue)
+			capped += ReconstructTree(data, node, minValue, maxChildren)
 			root.Children = append(root.Children, node)
 		}
 	}
+	return capped
 }
 
 type Query struct {
@@ -128,6 +142,6 @@ func (q *Query) GetStackFlamegraph(showFileNames bool) (*types.FlameGraphNode, e
 		ChildrenIds: data[rootId].ChildrenIds,
 	}
 
-	ReconstructTree(data, flameGraphTreeRoot, q.minValue)
+	ReconstructTree(data, flameGraphTreeRoot, q.minValue, 0)
 	return flameGraphTreeRoot, nil
 }
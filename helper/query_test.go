@@ -0,0 +1,82 @@
+package helper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Civil/ch-flamegraphs/types"
+)
+
+// describeTree prints the tree as "name(children)", truncated nodes are marked with '+'
+func describeTree(n *types.FlameGraphNode) string {
+	s := n.Name
+	if n.ChildrenTruncated {
+		s += "+"
+	}
+	if len(n.Children) == 0 {
+		return s
+	}
+	children := make([]string, 0, len(n.Children))
+	for _, c := range n.Children {
+		children = append(children, describeTree(c))
+	}
+	return s + "(" + strings.Join(children, " ") + ")"
+}
+
+func TestReconstructTree(t *testing.T) {
+	// root has 4 children, a has 3 and e was already truncated when it was stored
+	data := map[int64]types.ClickhouseField{
+		1:  {Id: 1, Name: "root", Value: 100, ChildrenIds: []int64{2, 3, 4, 5}},
+		2:  {Id: 2, Name: "a", Value: 50, ChildrenIds: []int64{6, 7, 8}},
+		3:  {Id: 3, Name: "b", Value: 5},
+		4:  {Id: 4, Name: "c", Value: 30},
+		5:  {Id: 5, Name: "d", Value: 15, ChildrenIds: []int64{9}},
+		6:  {Id: 6, Name: "x", Value: 20},
+		7:  {Id: 7, Name: "y", Value: 20},
+		8:  {Id: 8, Name: "z", Value: 10},
+		9:  {Id: 9, Name: "e", Value: 15, ChildrenIds: []int64{10}, ChildrenTruncated: 1},
+		10: {Id: 10, Name: "f", Value: 15},
+	}
+
+	tests := []struct {
+		name        string
+		minValue    int64
+		maxChildren int
+		expected    string
+		capped      int
+	}{
+		{name: "unlimited", expected: "root(a(x y z) b c d(e+(f)))"},
+		{name: "wide enough", maxChildren: 4, expected: "root(a(x y z) b c d(e+(f)))"},
+		{name: "root capped", maxChildren: 3, expected: "root+(a(x y z) b c)", capped: 1},
+		{name: "every wide node capped", maxChildren: 2, expected: "root+(a+(x y) b)", capped: 2},
+		{name: "single child", maxChildren: 1, expected: "root+(a+(x))", capped: 2},
+		{name: "min value", minValue: 10, expected: "root(a(x y) c d(e+(f)))"},
+		// The cap is applied to ids before trimming, so trimmed children still count towards it
+		{name: "min value and capped", minValue: 10, maxChildren: 2, expected: "root+(a+(x y))", capped: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := &types.FlameGraphNode{Id: 1, Name: "root", Value: 100, ChildrenIds: data[1].ChildrenIds}
+			capped := ReconstructTree(data, root, tt.minValue, tt.maxChildren)
+			if got := describeTree(root); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+			if capped != tt.capped {
+				t.Errorf("expected %v capped nodes, got %v", tt.capped, capped)
+			}
+		})
+	}
+}
+
+func TestReconstructTreeParents(t *testing.T) {
+	data := map[int64]types.ClickhouseField{
+		2: {Id: 2, Name: "a", Value: 10, ChildrenIds: []int64{3}},
+		3: {Id: 3, Name: "b", Value: 10},
+	}
+	root := &types.FlameGraphNode{Id: 1, Name: "root", Value: 10, ChildrenIds: []int64{2}}
+	ReconstructTree(data, root, 0, 0)
+	a := root.Children[0]
+	if a.Parent != root || a.Children[0].Parent != a {
+		t.Error("expected every node to point to its parent")
+	}
+}
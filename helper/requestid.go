@@ -0,0 +1,21 @@
+package helper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader is where a proxy in front of the service passes id of the request
+const RequestIDHeader = "X-Request-Id"
+
+// RequestID returns id the request came with or a new random one, so an error reported to the user can be
+// found in the logs
+func RequestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
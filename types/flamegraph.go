@@ -3,8 +3,13 @@ package types
 import (
 	"fmt"
 	"hash/fnv"
+	"math"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -23,9 +28,19 @@ type FlameGraphNode struct {
 	RdTime      int64             `json:"rdtime,omitempty"`
 	ATime       int64             `json:"atime,omitempty"`
 	Count       int64            `json:"count,omitempty"`
+	// Delta is a signed change of the value, only set for delta graph types where Value is its absolute value
+	Delta       int64            `json:"delta,omitempty"`
 	Children    []*FlameGraphNode `json:"children,omitempty"`
 	ChildrenIds []int64          `json:"-"`
 	Parent      *FlameGraphNode   `json:"-"`
+	// ChildrenTruncated is set when only the largest children were stored, so the subtree is partial
+	ChildrenTruncated bool `json:"truncated,omitempty"`
+	// UnreachableValue is only set on the root and tells how much of the value couldn't be attached to the tree
+	UnreachableValue int64 `json:"unreachableValue,omitempty"`
+	// FormatVersion is only set on the returned node and tells which version of the format the tree is in
+	FormatVersion int `json:"formatVersion,omitempty"`
+	// Synthetic nodes are generated by the server (e.g. to explain trimming) and don't correspond to any metric
+	Synthetic bool `json:"synthetic,omitempty"`
 }
 
 type sampleToNodeMap struct {
@@ -131,7 +146,183 @@ type Metrics struct {
 
 type Cluster struct {
 	Name  string
-	Hosts []string
+	Hosts []Host
+
+	// Only one of RemoveLowestPct or MinValue can be set. If none are set, global defaults are used
+	RemoveLowestPct float64
+	MinValue        int64
+
+	// MergeCaseDuplicates merges metrics whose names differ only by case, keeping the most common casing
+	MergeCaseDuplicates bool
+
+	// Flavor selects carbonserver implementation the hosts run: "go-carbon" (default), "carbonserver-classic" or
+	// "auto" to detect it once per host
+	Flavor string
+
+	// Source is where metric names come from: "carbonserver" (default), "prometheus" or "filesystem"
+	Source     string
+	Prometheus PrometheusSource
+	Filesystem FilesystemSource
+
+	// QueryPrefixes, if set, restricts the snapshot to metrics under these prefixes, e.g. "servers.dc3"
+	QueryPrefixes []string
+	// Parent makes this a virtual cluster that takes Hosts, Flavor and Source of the named cluster
+	Parent string
+	// Interval, if set, gives the cluster its own schedule instead of the global RerunInterval
+	Interval time.Duration
+	// DisableCompression stops the collector from asking carbonserver for gzip-compressed metric lists
+	DisableCompression bool
+	// StoreOnStructureChange stores a snapshot only if metrics appeared or disappeared since the last stored one,
+	// changes of sizes or counts alone are not stored
+	StoreOnStructureChange bool
+
+	// Port of carbonserver, 8080 if not set. Hosts given as "host:port" override it
+	Port *int
+	// PathPrefix is prepended to the path of metric lists, e.x. when carbonserver sits behind a reverse proxy.
+	// It can refer to metadata of hosts as {field}, e.x. "/carbon/{role}"
+	PathPrefix string
+	// ListPath, if set, replaces path and query the flavor uses to list metrics, e.x. "/metrics/details/?format=json".
+	// Like PathPrefix, it can refer to metadata of hosts.
+	ListPath string
+	// TLS, if set, makes the collector fetch metric lists over https
+	TLS *TLSConfig
+	// FetchTimeout limits a single request to a host, including download of the list. 2 minutes if not set
+	FetchTimeout time.Duration
+	// MinHostsSuccess is how many hosts must respond for the snapshot to be written, either a number ("3") or
+	// a percentage of Hosts ("75%"). By default a single host is enough
+	MinHostsSuccess string
+}
+
+// TLSConfig describes how to connect to carbonserver over https
+type TLSConfig struct {
+	// CAFile is a PEM bundle to verify certificates of carbonserver, system roots are used if it's empty
+	CAFile string
+	// CertFile and KeyFile are a client certificate, both or none must be set
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables verification of certificates of carbonserver
+	InsecureSkipVerify bool
+}
+
+// PrometheusSource builds the tree out of series of a Prometheus-compatible server, every series counts as 1
+type PrometheusSource struct {
+	URL string
+	// Selector, if set, makes the collector fetch /api/v1/series for it, otherwise only metric names are used
+	Selector string
+	// PathTemplate is a dot separated list of labels that makes up the path of a series, e.g. "job.instance.__name__"
+	PathTemplate string
+	// MaxSeries and MaxResponseBytes protect both sides from selectors that match too much
+	MaxSeries        int
+	MaxResponseBytes int64
+	// RequestInterval is minimal time between requests to the server
+	RequestInterval time.Duration
+}
+
+// FilesystemSource builds the tree out of whisper files under Root, for collectors running on the store itself
+type FilesystemSource struct {
+	Root string
+	// FollowSymlinks includes .wsp files that are symlinks. Symlinks to directories are never followed, so
+	// a loop can't make the walk endless
+	FollowSymlinks bool
+}
+
+const (
+	SourceCarbonserver = "carbonserver"
+	SourcePrometheus   = "prometheus"
+	SourceFilesystem   = "filesystem"
+)
+
+// MinHosts returns how many hosts must respond according to MinHostsSuccess, percentage is rounded up
+func (c *Cluster) MinHosts() (int, error) {
+	s := strings.TrimSpace(c.MinHostsSuccess)
+	if s == "" {
+		return 1, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return 0, fmt.Errorf("invalid MinHostsSuccess %v, percentage must be in (0, 100]", s)
+		}
+		n := int(math.Ceil(pct * float64(len(c.Hosts)) / 100))
+		if n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > len(c.Hosts) {
+		return 0, fmt.Errorf("invalid MinHostsSuccess %v, must be between 1 and amount of hosts (%v)", s, len(c.Hosts))
+	}
+	return n, nil
+}
+
+// GraphType returns graph_type snapshots of the cluster are stored with
+func (c *Cluster) GraphType() string {
+	if c.Source == SourcePrometheus {
+		return "prometheus_series"
+	}
+	return "graphite_metrics"
+}
+
+func (c *Cluster) Validate() error {
+	if c.RemoveLowestPct != 0 && c.MinValue != 0 {
+		return fmt.Errorf("cluster %v: only one of RemoveLowestPct or MinValue can be set", c.Name)
+	}
+	if c.RemoveLowestPct < 0 || c.MinValue < 0 {
+		return fmt.Errorf("cluster %v: RemoveLowestPct and MinValue can't be negative", c.Name)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("cluster %v: Interval can't be negative", c.Name)
+	}
+	if c.FetchTimeout < 0 {
+		return fmt.Errorf("cluster %v: FetchTimeout can't be negative", c.Name)
+	}
+	if _, err := c.MinHosts(); err != nil {
+		return fmt.Errorf("cluster %v: %v", c.Name, err)
+	}
+	for _, p := range c.QueryPrefixes {
+		if strings.Trim(p, ".*") == "" {
+			return fmt.Errorf("cluster %v: empty query prefix", c.Name)
+		}
+	}
+	if c.Port != nil && (*c.Port < 1 || *c.Port > 65535) {
+		return fmt.Errorf("cluster %v: invalid Port %v", c.Name, *c.Port)
+	}
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("cluster %v: PathPrefix must start with /", c.Name)
+	}
+	if c.ListPath != "" && !strings.HasPrefix(c.ListPath, "/") {
+		return fmt.Errorf("cluster %v: ListPath must start with /", c.Name)
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("cluster %v: both TLS.CertFile and TLS.KeyFile must be set", c.Name)
+	}
+	for _, h := range c.Hosts {
+		if _, port, err := net.SplitHostPort(h.Address); err == nil {
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("cluster %v: invalid port in host %v", c.Name, h)
+			}
+		}
+		for _, template := range []string{c.PathPrefix, c.ListPath} {
+			if _, err := h.Expand(template); err != nil {
+				return fmt.Errorf("cluster %v: %v", c.Name, err)
+			}
+		}
+	}
+	switch c.Source {
+	case "", SourceCarbonserver:
+	case SourcePrometheus:
+		if c.Prometheus.URL == "" {
+			return fmt.Errorf("cluster %v: Prometheus.URL must be set", c.Name)
+		}
+	case SourceFilesystem:
+		if c.Filesystem.Root == "" {
+			return fmt.Errorf("cluster %v: Filesystem.Root must be set", c.Name)
+		}
+	default:
+		return fmt.Errorf("cluster %v: unknown source %v", c.Name, c.Source)
+	}
+	return nil
 }
 
 type ClickhouseField struct {
@@ -146,4 +337,7 @@ type ClickhouseField struct {
 	Level       uint64
 	ParentID    int64
 	ChildrenIds []int64
+	Delta       int64
+
+	ChildrenTruncated uint8
 }
@@ -0,0 +1,65 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Host is a carbonserver host of a cluster. In config it's either a plain address or an object with "address"
+// and arbitrary metadata fields (role, shard, ...) that can be used in PathPrefix and ListPath as {field}.
+type Host struct {
+	Address  string
+	Metadata map[string]string
+}
+
+func (h *Host) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&h.Address); err == nil {
+		return nil
+	}
+	var fields map[string]string
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	h.Address = fields["address"]
+	if h.Address == "" {
+		return fmt.Errorf("host %v: address must be set", fields)
+	}
+	delete(fields, "address")
+	h.Metadata = fields
+	return nil
+}
+
+func (h Host) String() string {
+	return h.Address
+}
+
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// Expand replaces {field} placeholders in the template with metadata of the host, {address} is always known
+func (h Host) Expand(template string) (string, error) {
+	var missing string
+	res := placeholderRe.ReplaceAllStringFunc(template, func(p string) string {
+		key := p[1 : len(p)-1]
+		if key == "address" {
+			return h.Address
+		}
+		v, ok := h.Metadata[key]
+		if !ok && missing == "" {
+			missing = key
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("host %v has no %v for %v", h.Address, missing, template)
+	}
+	return res, nil
+}
+
+// HostAddresses returns addresses of the hosts
+func HostAddresses(hosts []Host) []string {
+	res := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		res = append(res, h.Address)
+	}
+	return res
+}